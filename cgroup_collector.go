@@ -0,0 +1,179 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/nm-morais/demmon-exporter/internal/procfs"
+)
+
+const defaultCgroupRoot = "/sys/fs/cgroup"
+
+// cgroupCPUCounters maps the cpu.stat entries reported by CgroupCollector to
+// their metric names and the factor that converts them to the metric's unit.
+var cgroupCPUCounters = []struct {
+	key, name string
+	scale     float64
+}{
+	{"usage_usec", "cgroup_cpu_usage_seconds", 1e-6},
+	{"user_usec", "cgroup_cpu_user_seconds", 1e-6},
+	{"system_usec", "cgroup_cpu_system_seconds", 1e-6},
+	{"nr_periods", "cgroup_cpu_periods", 1},
+	{"nr_throttled", "cgroup_cpu_throttled_periods", 1},
+	{"throttled_usec", "cgroup_cpu_throttled_seconds", 1e-6},
+}
+
+// cgroupMemoryStats are the memory.stat entries, in bytes, reported with a
+// type label.
+var cgroupMemoryStats = []string{
+	"anon", "file", "kernel_stack", "slab", "sock", "shmem", "file_mapped", "file_dirty", "file_writeback",
+	"active_anon", "inactive_anon", "active_file", "inactive_file", "unevictable",
+}
+
+// cgroupIOCounters maps the io.stat counters to their metric names.
+var cgroupIOCounters = []struct{ key, name string }{
+	{"rbytes", "cgroup_io_read_bytes"},
+	{"wbytes", "cgroup_io_written_bytes"},
+	{"rios", "cgroup_io_reads"},
+	{"wios", "cgroup_io_writes"},
+}
+
+// CgroupCollector reports the resource usage of the cgroup v2 the process
+// runs in, which in a container is that of the container: CPU usage and
+// throttling, memory, I/O per device and number of tasks. Every series has a
+// cgroup label with the cgroup's path. Files of controllers that are not
+// enabled for the cgroup are skipped.
+type CgroupCollector struct {
+	procRoot   string
+	cgroupRoot string
+
+	mtx  sync.Mutex
+	prev *totals
+}
+
+// NewCgroupCollector returns a CgroupCollector that finds the cgroup of the
+// process in the procfs at procRoot, /proc if empty, and reads it from the
+// cgroup v2 hierarchy mounted at cgroupRoot, /sys/fs/cgroup if empty.
+// Conf.CgroupMetrics registers one.
+func NewCgroupCollector(procRoot, cgroupRoot string) *CgroupCollector {
+	if procRoot == "" {
+		procRoot = defaultProcRoot
+	}
+
+	if cgroupRoot == "" {
+		cgroupRoot = defaultCgroupRoot
+	}
+
+	return &CgroupCollector{procRoot: procRoot, cgroupRoot: cgroupRoot, prev: newTotals()}
+}
+
+// Describe implements Collector.
+func (c *CgroupCollector) Describe() []Desc {
+	descs := make([]Desc, 0, len(cgroupCPUCounters)+len(cgroupIOCounters)+6)
+
+	for _, cpu := range cgroupCPUCounters {
+		descs = append(descs, Desc{Name: cpu.name, Kind: KindCounter, Help: cpu.key + " in cpu.stat.", Samples: 1})
+	}
+
+	for _, io := range cgroupIOCounters {
+		descs = append(descs, Desc{Name: io.name, Kind: KindCounter, Help: io.key + " in io.stat, per device.", Samples: 1})
+	}
+
+	return append(descs,
+		Desc{Name: "cgroup_memory_current_bytes", Kind: KindGauge, Help: "Memory in use.", Samples: 1},
+		Desc{Name: "cgroup_memory_max_bytes", Kind: KindGauge, Help: "Memory limit, if any.", Samples: 1},
+		Desc{Name: "cgroup_memory_stat_bytes", Kind: KindGauge, Help: "Memory use by type, from memory.stat.", Samples: 1},
+		Desc{Name: "cgroup_memory_page_faults", Kind: KindCounter, Help: "Page faults by type.", Samples: 1},
+		Desc{Name: "cgroup_pids_current", Kind: KindGauge, Help: "Number of tasks.", Samples: 1},
+	)
+}
+
+// Collect implements Collector.
+func (c *CgroupCollector) Collect(ctx context.Context, emit EmitFunc) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	cgroup, err := procfs.ReadCgroupPath(filepath.Join(c.procRoot, "self", "cgroup"))
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(c.cgroupRoot, cgroup)
+
+	labels := func(labelValues ...string) map[string]string {
+		l := map[string]string{"cgroup": cgroup}
+		for i := 0; i+1 < len(labelValues); i += 2 {
+			l[labelValues[i]] = labelValues[i+1]
+		}
+
+		return l
+	}
+
+	emitGauge := func(name string, v float64, labelValues ...string) {
+		emit(name, labels(labelValues...), map[string]interface{}{"value": v})
+	}
+
+	emitCounter := func(name string, total float64, labelValues ...string) {
+		key := name
+		for _, lv := range labelValues {
+			key += "\xff" + lv
+		}
+
+		// the first read of a total is only its baseline
+		if d, ok := c.prev.increase(key, total); ok {
+			emit(name, labels(labelValues...), map[string]interface{}{"count": d})
+		}
+	}
+
+	if stat, err := procfs.ReadKeyValues(filepath.Join(dir, "cpu.stat")); err == nil {
+		for _, cpu := range cgroupCPUCounters {
+			if v, err := strconv.ParseUint(stat[cpu.key], 10, 64); err == nil {
+				emitCounter(cpu.name, float64(v)*cpu.scale)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if v, ok, err := procfs.ReadUint(filepath.Join(dir, "memory.current")); err == nil && ok {
+		emitGauge("cgroup_memory_current_bytes", float64(v))
+	}
+
+	if v, ok, err := procfs.ReadUint(filepath.Join(dir, "memory.max")); err == nil && ok {
+		emitGauge("cgroup_memory_max_bytes", float64(v))
+	}
+
+	if stat, err := procfs.ReadKeyValues(filepath.Join(dir, "memory.stat")); err == nil {
+		for _, key := range cgroupMemoryStats {
+			if v, err := strconv.ParseUint(stat[key], 10, 64); err == nil {
+				emitGauge("cgroup_memory_stat_bytes", float64(v), "type", key)
+			}
+		}
+
+		for key, typ := range map[string]string{"pgfault": "minor", "pgmajfault": "major"} {
+			if v, err := strconv.ParseUint(stat[key], 10, 64); err == nil {
+				emitCounter("cgroup_memory_page_faults", float64(v), "type", typ)
+			}
+		}
+	}
+
+	if devs, err := procfs.ReadIOStat(filepath.Join(dir, "io.stat")); err == nil {
+		for dev, counters := range devs {
+			for _, io := range cgroupIOCounters {
+				if v, ok := counters[io.key]; ok {
+					emitCounter(io.name, float64(v), "device", dev)
+				}
+			}
+		}
+	}
+
+	if v, ok, err := procfs.ReadUint(filepath.Join(dir, "pids.current")); err == nil && ok {
+		emitGauge("cgroup_pids_current", float64(v))
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nm-morais/demmon-exporter/internal/procfs"
+)
+
+const cgroupFixtures = "internal/procfs/testdata/cgroup"
+
+func TestCgroupCollector(t *testing.T) {
+	const service = "system.slice/app.service"
+
+	// the cgroup fixtures are copied so that the counters can be increased
+	root := t.TempDir()
+	dir := filepath.Join(root, service)
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(cgroupFixtures, service))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(cgroupFixtures, service, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, f.Name()), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCgroupCollector(procFixtures, root)
+
+	described := map[string]bool{}
+	for _, d := range c.Describe() {
+		described[d.Name] = true
+	}
+
+	first := collectedSeries(t, c)
+
+	for key := range first {
+		name := key
+		if i := strings.IndexByte(key, '{'); i >= 0 {
+			name = key[:i]
+		}
+
+		if !described[name] {
+			t.Errorf("%s was collected but not described", name)
+		}
+	}
+
+	cg := "cgroup=/system.slice/app.service"
+
+	// memory.max is "max", so there is no limit to report
+	want := map[string]float64{
+		"cgroup_memory_current_bytes{" + cg + "}":                  52428800,
+		"cgroup_pids_current{" + cg + "}":                          12,
+		"cgroup_memory_stat_bytes{" + cg + ",type=anon}":           20971520,
+		"cgroup_memory_stat_bytes{" + cg + ",type=file}":           31457280,
+		"cgroup_memory_stat_bytes{" + cg + ",type=kernel_stack}":   131072,
+		"cgroup_memory_stat_bytes{" + cg + ",type=slab}":           1048576,
+		"cgroup_memory_stat_bytes{" + cg + ",type=sock}":           0,
+		"cgroup_memory_stat_bytes{" + cg + ",type=shmem}":          4096,
+		"cgroup_memory_stat_bytes{" + cg + ",type=file_mapped}":    8192,
+		"cgroup_memory_stat_bytes{" + cg + ",type=file_dirty}":     0,
+		"cgroup_memory_stat_bytes{" + cg + ",type=file_writeback}": 0,
+		"cgroup_memory_stat_bytes{" + cg + ",type=active_anon}":    0,
+		"cgroup_memory_stat_bytes{" + cg + ",type=inactive_anon}":  20971520,
+		"cgroup_memory_stat_bytes{" + cg + ",type=active_file}":    1048576,
+		"cgroup_memory_stat_bytes{" + cg + ",type=inactive_file}":  30408704,
+		"cgroup_memory_stat_bytes{" + cg + ",type=unevictable}":    0,
+	}
+
+	// the first collection only reads the baselines of the counters
+	t.Run("first", func(t *testing.T) { checkSeries(t, first, want) })
+
+	rewriteFixture(t, dir, "cpu.stat", "usage_usec 2500000", "usage_usec 3000000")
+	rewriteFixture(t, dir, "io.stat", "8:0 rbytes=1048576", "8:0 rbytes=1052672")
+
+	for key, v := range map[string]float64{
+		"cgroup_cpu_usage_seconds{" + cg + "}":             0.5,
+		"cgroup_cpu_user_seconds{" + cg + "}":              0,
+		"cgroup_cpu_system_seconds{" + cg + "}":            0,
+		"cgroup_cpu_periods{" + cg + "}":                   0,
+		"cgroup_cpu_throttled_periods{" + cg + "}":         0,
+		"cgroup_cpu_throttled_seconds{" + cg + "}":         0,
+		"cgroup_memory_page_faults{" + cg + ",type=minor}": 0,
+		"cgroup_memory_page_faults{" + cg + ",type=major}": 0,
+		"cgroup_io_read_bytes{" + cg + ",device=8:0}":      4096,
+		"cgroup_io_written_bytes{" + cg + ",device=8:0}":   0,
+		"cgroup_io_reads{" + cg + ",device=8:0}":           0,
+		"cgroup_io_writes{" + cg + ",device=8:0}":          0,
+		"cgroup_io_read_bytes{" + cg + ",device=253:1}":    0,
+		"cgroup_io_written_bytes{" + cg + ",device=253:1}": 0,
+		"cgroup_io_reads{" + cg + ",device=253:1}":         0,
+		"cgroup_io_writes{" + cg + ",device=253:1}":        0,
+	} {
+		want[key] = v
+	}
+
+	t.Run("second", func(t *testing.T) { checkSeries(t, collectedSeries(t, c), want) })
+}
+
+func TestCgroupCollectorHierarchies(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cgroup  string
+		files   map[string]string
+		want    map[string]float64
+		wantErr error
+	}{
+		{
+			name:    "v1 only",
+			cgroup:  "12:pids:/user.slice\n1:name=systemd:/user.slice\n",
+			wantErr: procfs.ErrNoUnifiedCgroup,
+		},
+		{
+			name:   "pids controller only",
+			cgroup: "0::/app\n",
+			files:  map[string]string{"app/pids.current": "3\n"},
+			want:   map[string]float64{"cgroup_pids_current{cgroup=/app}": 3},
+		},
+		{
+			name:   "memory limit",
+			cgroup: "0::/\n",
+			files:  map[string]string{"memory.current": "1024\n", "memory.max": "4096\n"},
+			want: map[string]float64{
+				"cgroup_memory_current_bytes{cgroup=/}": 1024,
+				"cgroup_memory_max_bytes{cgroup=/}":     4096,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			procRoot, cgroupRoot := t.TempDir(), t.TempDir()
+
+			files := map[string]string{filepath.Join(procRoot, "self", "cgroup"): tc.cgroup}
+			for name, content := range tc.files {
+				files[filepath.Join(cgroupRoot, name)] = content
+			}
+
+			for path, content := range files {
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := NewCgroupCollector(procRoot, cgroupRoot)
+
+			if tc.wantErr != nil {
+				err := c.Collect(context.Background(), func(string, map[string]string, map[string]interface{}) {})
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("Collect() error = %v, want %v", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			checkSeries(t, collectedSeries(t, c), tc.want)
+		})
+	}
+}
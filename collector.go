@@ -0,0 +1,449 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nm-morais/demmon-common/body_types"
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+	"go.uber.org/atomic"
+)
+
+const (
+	defaultCollectorTimeout = time.Second
+	maxPendingCollections   = 64
+)
+
+var (
+	ErrCollectorRegistered = errors.New("collector is already registered")
+	ErrInvalidCollector    = errors.New("invalid collector")
+	ErrInvalidDesc         = errors.New("invalid metric description")
+
+	errUndescribedMetric = errors.New("metric was not described by its collector")
+	errCollectionRunning = errors.New("previous collection is still running")
+)
+
+// Desc describes a metric emitted by a Collector. Samples is the number of
+// samples demmon keeps in the metric's bucket.
+type Desc struct {
+	Name    string
+	Kind    Kind
+	Help    string
+	Samples int
+}
+
+// EmitFunc records one series of a collected metric: its labels, which are
+// merged with the exporter's global tags, and its fields.
+type EmitFunc func(name string, labels map[string]string, fields map[string]interface{})
+
+// Collector is a source of metrics that are read, rather than observed, such
+// as system statistics. Describe lists the metrics the collector emits; it is
+// called once, on registration. Collect emits their current series and must
+// stop once ctx is done.
+type Collector interface {
+	Describe() []Desc
+	Collect(ctx context.Context, emit EmitFunc) error
+}
+
+// CollectorOpts configure a registered collector. Collect is called with a
+// deadline of Timeout, 1s by default. With a zero Interval it is called on
+// every export; otherwise it is called every Interval in the background and
+// its series are held until the next export, each collection covering the
+// time since the previous one.
+type CollectorOpts struct {
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+type registeredCollector struct {
+	collector Collector
+	opts      CollectorOpts
+	kinds     map[string]Kind
+	entries   map[string]*metricEntry
+	running   *atomic.Bool
+	stop      chan struct{}
+
+	mtx      sync.Mutex
+	pending  [][]Series
+	series   map[string]map[string]struct{} // admitted by the limiter
+	released bool
+}
+
+// RegisterCollector registers c, which must be a pointer. Its metrics are
+// exported along with the others; a collector that fails, panics or times out
+// only loses its own series. Its series are capped like those of the other
+// metrics, by MaxSeriesPerMetric and MaxSeries.
+func (e *Exporter) RegisterCollector(c Collector, opts CollectorOpts) error {
+	if !isPointer(c) {
+		return fmt.Errorf("%w: %T is not a pointer", ErrInvalidCollector, c)
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultCollectorTimeout
+	}
+
+	descs := c.Describe()
+	kinds := make(map[string]Kind, len(descs))
+
+	for _, d := range descs {
+		if d.Name == "" {
+			return fmt.Errorf("%w: empty name", ErrInvalidDesc)
+		}
+
+		if _, ok := kinds[d.Name]; ok {
+			return fmt.Errorf("%w: %s described twice", ErrInvalidDesc, d.Name)
+		}
+
+		kinds[d.Name] = d.Kind
+	}
+
+	r := &registeredCollector{
+		collector: c,
+		opts:      opts,
+		kinds:     kinds,
+		entries:   make(map[string]*metricEntry, len(descs)),
+		running:   atomic.NewBool(false),
+		stop:      make(chan struct{}),
+		series:    map[string]map[string]struct{}{},
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	for _, other := range e.collectors {
+		if other.collector == c {
+			return ErrCollectorRegistered
+		}
+	}
+
+	for _, d := range descs {
+		m, err := e.registerLocked(MetricInfo{Name: d.Name, Kind: d.Kind, Samples: d.Samples})
+		if err != nil {
+			// the metrics registered so far are released, and those created
+			// for c unregistered
+			for _, registered := range r.entries {
+				e.releaseLocked(registered)
+			}
+
+			return err
+		}
+
+		m.collectors++
+		r.entries[d.Name] = m
+	}
+
+	for _, d := range descs {
+		if d.Help != "" {
+			e.help[d.Name] = d.Help
+		}
+	}
+
+	e.collectors = append(e.collectors, r)
+
+	if opts.Interval > 0 {
+		go e.collectLoop(r)
+	}
+
+	return nil
+}
+
+// UnregisterCollector unregisters c and reports whether it was registered.
+// The metrics it described are unregistered too, unless they are also used by
+// another collector, a handle or a callback. Series it collected in the
+// background and that were not exported yet are discarded.
+func (e *Exporter) UnregisterCollector(c Collector) bool {
+	if !isPointer(c) {
+		return false
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for i, r := range e.collectors {
+		if r.collector != c {
+			continue
+		}
+
+		close(r.stop)
+		e.collectors = append(e.collectors[:i:i], e.collectors[i+1:]...)
+		r.release(e.limiter)
+
+		for _, m := range r.entries {
+			e.releaseLocked(m)
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// isPointer reports whether c is a non-nil pointer, which unlike other
+// dynamic types can always be compared with ==.
+func isPointer(c Collector) bool {
+	v := reflect.ValueOf(c)
+
+	return v.Kind() == reflect.Ptr && !v.IsNil()
+}
+
+// release gives back the room the series of r took in limiter, and stops r
+// from taking more.
+func (r *registeredCollector) release(limiter *lv.Limiter) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.released = true
+
+	if limiter != nil {
+		for name, series := range r.series {
+			limiter.Release(name, len(series))
+		}
+	}
+
+	r.series = nil
+}
+
+// admitCollected returns the label values under which the series of the named
+// metric identified by lvs is collected: its own once the limiter admitted
+// it, or the overflow ones if the limiter folds it. It returns false if the
+// limiter drops the series.
+func (e *Exporter) admitCollected(r *registeredCollector, name string, lvs lv.LabelValues) (lv.LabelValues, bool) {
+	if e.limiter == nil {
+		return lvs, true
+	}
+
+	key := strings.Join(lvs, "\xff")
+
+	r.mtx.Lock()
+	_, ok := r.series[name][key]
+	if !ok && !r.released && e.limiter.Admit(name) {
+		if r.series[name] == nil {
+			r.series[name] = map[string]struct{}{}
+		}
+
+		r.series[name][key] = struct{}{}
+		ok = true
+	}
+	r.mtx.Unlock()
+
+	if ok {
+		return lvs, true
+	}
+
+	if !e.limiter.Fold() {
+		e.reject(name, lvs, lv.ErrSeriesDropped)
+		return nil, false
+	}
+
+	e.reject(name, lvs, lv.ErrSeriesFolded)
+
+	return lv.OverflowLabelValues, true
+}
+
+// releaseLocked drops the claim of a collector on m, and unregisters m if
+// nothing else uses it. The caller holds e.mtx.
+func (e *Exporter) releaseLocked(m *metricEntry) {
+	m.collectors--
+
+	name := m.info.Name
+	if m.collectors > 0 || m.handle != nil || e.metrics[name] != m {
+		return
+	}
+
+	for _, f := range e.funcs {
+		if f.name == name {
+			return
+		}
+	}
+
+	m.remove(nil)
+	delete(e.metrics, name)
+	delete(e.help, name)
+}
+
+// collectLoop collects r every interval until it is unregistered or the
+// exporter is shut down. The counters and histograms of each collection start
+// at the previous one.
+func (e *Exporter) collectLoop(r *registeredCollector) {
+	t := time.NewTicker(r.opts.Interval)
+	defer t.Stop()
+
+	start := time.Now()
+
+	for {
+		select {
+		case <-t.C:
+			now := time.Now()
+
+			bp, err := e.collect(r, now)
+			if err != nil {
+				e.logger.Errorf("Error collecting %T: %s", r.collector, err)
+			}
+
+			for i := range bp {
+				if bp[i].Kind != KindGauge && bp[i].Kind != KindUntyped {
+					bp[i].Start = start
+				}
+			}
+
+			start = now
+
+			if len(bp) == 0 {
+				continue
+			}
+
+			r.mtx.Lock()
+			if len(r.pending) == maxPendingCollections {
+				r.pending = r.pending[1:]
+			}
+			r.pending = append(r.pending, bp)
+			r.mtx.Unlock()
+		case <-r.stop:
+			return
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// gatherCollectors returns the series of every registered collector: those
+// collected in the background since the previous export, and freshly
+// collected ones for collectors without an interval, which are called
+// concurrently.
+func (e *Exporter) gatherCollectors(now time.Time) []Series {
+	e.mtx.Lock()
+	collectors := make([]*registeredCollector, len(e.collectors))
+	copy(collectors, e.collectors)
+	e.mtx.Unlock()
+
+	var (
+		wg  sync.WaitGroup
+		mtx sync.Mutex
+		bp  []Series
+	)
+
+	for _, r := range collectors {
+		if r.opts.Interval > 0 {
+			r.mtx.Lock()
+			pending := r.pending
+			r.pending = nil
+			r.mtx.Unlock()
+
+			mtx.Lock()
+			for _, collected := range pending {
+				bp = append(bp, collected...)
+			}
+			mtx.Unlock()
+
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(r *registeredCollector) {
+			defer wg.Done()
+
+			collected, err := e.collect(r, now)
+			if err != nil {
+				e.logger.Errorf("Error collecting %T: %s", r.collector, err)
+			}
+
+			mtx.Lock()
+			bp = append(bp, collected...)
+			mtx.Unlock()
+		}(r)
+	}
+
+	wg.Wait()
+
+	// metrics unregistered by Unregister are no longer exported
+	return e.registeredOnly(bp)
+}
+
+// collect calls the collector with its timeout and returns the series it
+// emitted in time, stamped with now. A collector still running from a
+// previous call is not called again until it returns.
+func (e *Exporter) collect(r *registeredCollector, now time.Time) ([]Series, error) {
+	if !r.running.CAS(false, true) {
+		return nil, errCollectionRunning
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	var (
+		mtx  sync.Mutex
+		bp   []Series
+		over bool
+	)
+
+	emit := func(name string, labels map[string]string, fields map[string]interface{}) {
+		lvs := make(lv.LabelValues, 0, 2*len(labels))
+		for _, k := range sortedKeys(labels) {
+			lvs = append(lvs, k, labels[k])
+		}
+
+		kind, ok := r.kinds[name]
+		if !ok {
+			e.reject(name, lvs, errUndescribedMetric)
+			return
+		}
+
+		lvs, ok = e.admitCollected(r, name, lvs)
+		if !ok {
+			return
+		}
+
+		tags := mergeTags(e.tags, lvs)
+		dto := body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now))
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if !over {
+			bp = append(bp, Series{Kind: kind, TimeseriesDTO: dto})
+		}
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		defer r.running.Store(false)
+
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("collector panicked: %v", p)
+			}
+		}()
+
+		done <- r.collector.Collect(ctx, emit)
+	}()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	over = true
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bp, nil
+}
@@ -0,0 +1,141 @@
+package exporter
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errNotConnected     = errors.New("not connected to demmon")
+	errConnectionClosed = errors.New("connection to demmon closed")
+)
+
+// supervise watches the connection's error channel and, whenever the
+// connection drops, redials demmon until it succeeds. Exports are deferred to
+// the retry queue or spool while the exporter is disconnected.
+func (e *Exporter) supervise(errChan chan error) {
+	for {
+		var err error
+
+		select {
+		case <-e.done:
+			return
+		case connErr, ok := <-errChan:
+			if !ok || connErr == nil {
+				connErr = errConnectionClosed
+			}
+
+			err = connErr
+		}
+
+		e.connected.Store(false)
+		e.logger.Errorf("Lost connection to demmon: %s", err)
+
+		if e.conf.OnDisconnect != nil {
+			e.conf.OnDisconnect(err)
+		}
+
+		var ok bool
+		if errChan, ok = e.redial(); !ok {
+			return
+		}
+
+		e.tryInstallBuckets()
+		e.connected.Store(true)
+		e.logger.Info("Reconnected to demmon")
+
+		if e.conf.OnReconnect != nil {
+			e.conf.OnReconnect()
+		}
+	}
+}
+
+// redial dials demmon with exponential backoff until it succeeds, returning
+// the new connection's error channel, or until the exporter is closed. No dial
+// is attempted once Shutdown has begun, and a connection made while it began
+// is closed again.
+func (e *Exporter) redial() (chan error, bool) {
+	backoff := e.conf.DialBackoffTime
+
+	for {
+		select {
+		case <-e.done:
+			return nil, false
+		default:
+		}
+
+		connectErr, errChan := e.client.ConnectTimeout(e.conf.DialTimeout)
+		if connectErr == nil {
+			select {
+			case <-e.done:
+				e.client.Disconnect()
+				return nil, false
+			default:
+				return errChan, true
+			}
+		}
+
+		e.logger.Warnf("Could not reconnect to demmon, retrying in %s: %s", backoff, connectErr)
+
+		select {
+		case <-e.done:
+			return nil, false
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > e.conf.ReconnectMaxBackoff {
+			backoff = e.conf.ReconnectMaxBackoff
+		}
+
+		if backoff <= 0 {
+			backoff = e.conf.ReconnectMaxBackoff
+		}
+	}
+}
+
+// tryInstallBuckets installs the buckets, logging a failure. Buckets that
+// could not be installed are tried again on the next tick of the export loop
+// and whenever demmon is redialed.
+func (e *Exporter) tryInstallBuckets() {
+	err := e.installBuckets()
+
+	e.mtx.Lock()
+	e.bucketsPending = err != nil
+	e.mtx.Unlock()
+
+	if err != nil {
+		e.logger.Errorf("Error installing buckets: %s", err)
+	}
+}
+
+// installBuckets installs a demmon bucket for every metric created so far. It
+// is a no-op until ExportLoop has set the bucket frequency, and without demmon.
+func (e *Exporter) installBuckets() error {
+	e.mtx.Lock()
+	interval := e.bucketInterval
+	buckets := make(map[string]int, len(e.metrics))
+
+	for bName, m := range e.metrics {
+		buckets[bName] = m.info.Samples
+	}
+	e.mtx.Unlock()
+
+	if interval == 0 || e.client == nil {
+		return nil
+	}
+
+	for bName, bSampleCount := range buckets {
+		e.logger.Infof("installing bucket %s...", bName)
+
+		if err := e.client.InstallBucket(bName, interval, bSampleCount); err != nil {
+			return err
+		}
+
+		e.mtx.Lock()
+		e.installed[bName] = true
+		e.mtx.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,344 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/retry"
+	"github.com/nm-morais/demmon-exporter/internal/series"
+)
+
+// ErrInvalidRetryConf is returned by New for a backoff factor below 1 or a
+// jitter outside [0, 1].
+var ErrInvalidRetryConf = errors.New("invalid retry configuration")
+
+// Stats reports the state of the exporter's delivery pipeline, so callers can
+// tell when the importer is falling behind, along with the number of distinct
+// series per metric name whose observations were dropped or folded into the
+// overflow series. Rejected series are counted up to 16384 per metric.
+type Stats struct {
+	RetryQueueDepth int
+	RetryDropped    uint64
+	SpoolBytes      int64
+	SpoolDropped    uint64
+	Rejected        map[string]uint64
+}
+
+// Stats returns a snapshot of the delivery pipeline counters.
+func (e *Exporter) Stats() Stats {
+	s := Stats{Rejected: map[string]uint64{}}
+
+	e.mtx.Lock()
+	for name, rejected := range e.rejected {
+		s.Rejected[name] = uint64(len(rejected))
+	}
+	e.mtx.Unlock()
+
+	if e.retries != nil {
+		s.RetryQueueDepth = e.retries.Len()
+		s.RetryDropped = e.retries.Dropped()
+	}
+
+	if e.spool != nil {
+		s.SpoolBytes = e.spool.Size()
+		s.SpoolDropped = e.spool.Dropped()
+	}
+
+	return s
+}
+
+func setRetryDefaults(confs *Conf) error {
+	switch {
+	case confs.DisableRetries:
+		confs.RetryMaxAttempts = 1
+	case confs.RetryMaxAttempts == 0:
+		confs.RetryMaxAttempts = defaultRetryMaxAttempts
+	}
+
+	if confs.RetryInitialBackoff == 0 {
+		confs.RetryInitialBackoff = defaultRetryInitialBackoff
+	}
+
+	if confs.RetryMaxBackoff == 0 {
+		confs.RetryMaxBackoff = defaultRetryMaxBackoff
+	}
+
+	if confs.RetryBackoffFactor == 0 {
+		confs.RetryBackoffFactor = defaultRetryBackoffFactor
+	}
+
+	switch {
+	case confs.DisableRetryJitter:
+		confs.RetryJitter = 0
+	case confs.RetryJitter == 0:
+		confs.RetryJitter = defaultRetryJitter
+	}
+
+	if confs.RetryBackoffFactor < 1 {
+		return fmt.Errorf("%w: backoff factor %v is below 1", ErrInvalidRetryConf, confs.RetryBackoffFactor)
+	}
+
+	if confs.RetryJitter < 0 || confs.RetryJitter > 1 {
+		return fmt.Errorf("%w: jitter %v is outside [0, 1]", ErrInvalidRetryConf, confs.RetryJitter)
+	}
+
+	return nil
+}
+
+// sinkSet is a set of sinks, by name.
+type sinkSet map[string]bool
+
+// downSinks returns the sinks known to be unable to take a batch, which are
+// held back from rather than tried.
+func (e *Exporter) downSinks() sinkSet {
+	down := sinkSet{}
+
+	for i, s := range e.sinks {
+		if d, ok := s.(*DemmonSink); ok && d.down() {
+			down[e.sinkNames[i]] = true
+		}
+	}
+
+	return down
+}
+
+// pushTo pushes a batch to its target sinks that are not down, and marks the
+// ones that fail as down, so that what is pushed to them after it during the
+// same export is held back and stays in order. It returns the targets that
+// failed, along with the error, and those it held back. Targets that are no
+// longer configured are dropped.
+func (e *Exporter) pushTo(ctx context.Context, b series.Batch, down sinkSet) (failed, held []string, err error) {
+	targets := b.Targets
+	if len(targets) == 0 {
+		targets = e.sinkNames
+	}
+
+	sinks := make([]Sink, 0, len(targets))
+	tried := make([]string, 0, len(targets))
+
+	for _, name := range targets {
+		idx, ok := e.sinkIdx[name]
+		if !ok {
+			e.logger.Warnf("Dropping %d series deferred for sink %s, which is not configured", len(b.Series), name)
+			continue
+		}
+
+		if down[name] {
+			held = append(held, name)
+			continue
+		}
+
+		sinks = append(sinks, e.sinks[idx])
+		tried = append(tried, name)
+	}
+
+	if len(sinks) == 0 {
+		return nil, held, nil
+	}
+
+	err = NewFanoutSink(sinks...).Push(ctx, b.Series)
+	if err == nil {
+		return nil, held, nil
+	}
+
+	failed = tried
+
+	var fanoutErr *FanoutError
+	if errors.As(err, &fanoutErr) {
+		failed = make([]string, 0, len(fanoutErr.Failed))
+		for _, i := range fanoutErr.Failed {
+			failed = append(failed, tried[i])
+		}
+	}
+
+	for _, name := range failed {
+		down[name] = true
+	}
+
+	return failed, held, err
+}
+
+// push is pushTo for the retry queue and the spool. On failure it returns the
+// batch narrowed down to the targets that failed or were held back, and
+// retry.ErrHeld if none of them failed.
+func (e *Exporter) push(ctx context.Context, b series.Batch, down sinkSet) (series.Batch, error) {
+	failed, held, err := e.pushTo(ctx, b, down)
+	if err == nil && len(held) == 0 {
+		return series.Batch{}, nil
+	}
+
+	if err == nil {
+		err = retry.ErrHeld
+	}
+
+	return series.Batch{Series: b.Series, Targets: append(failed, held...)}, err
+}
+
+// retryPending pushes the queued batches whose backoff has elapsed. Batches
+// that ran out of attempts are moved to the spool. Batches are held back from
+// the sinks that are down, such as demmon while it is disconnected, so that
+// they do not use up their attempts on a sink known to be down.
+func (e *Exporter) retryPending(ctx context.Context, down sinkSet) error {
+	if e.retries == nil {
+		return nil
+	}
+
+	exhausted, err := e.retries.Retry(time.Now(), func(b series.Batch) (series.Batch, error) {
+		return e.push(ctx, b, down)
+	})
+	for _, b := range exhausted {
+		e.spoolBatch(b)
+	}
+
+	return err
+}
+
+// scheduleRetry arms t to fire when the next queued batch is due.
+func (e *Exporter) scheduleRetry(t *time.Timer) {
+	if e.retries == nil {
+		return
+	}
+
+	next, ok := e.retries.NextDue()
+	if !ok {
+		return
+	}
+
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+
+	t.Reset(time.Until(next))
+}
+
+// deferSeries hands series that could not be pushed to the given sinks to the
+// retry queue, in chunks of at most MaxSeriesPerRequest, or straight to the
+// spool when there is no retry queue. attempted tells whether the push of the
+// series was attempted, and counts as one of their attempts, or whether they
+// were held back without being sent.
+func (e *Exporter) deferSeries(bp []Series, targets []string, attempted bool) {
+	now := time.Now()
+
+	for i := 0; i < len(bp); i += e.conf.MaxSeriesPerRequest {
+		nrToDefer := e.conf.MaxSeriesPerRequest
+		if i+nrToDefer > len(bp) {
+			nrToDefer = len(bp) - i
+		}
+
+		b := series.Batch{Series: bp[i : i+nrToDefer], Targets: targets}
+
+		if e.retries == nil {
+			e.spoolBatch(b)
+			continue
+		}
+
+		attempts := 0
+		if attempted {
+			attempts = 1
+		}
+
+		if evicted := e.retries.Push(b, attempts, now); evicted != nil {
+			e.spoolBatch(*evicted)
+		}
+	}
+}
+
+// replaySpool pushes the batches left in the spool by previous failed exports,
+// oldest first. Each sink is replayed on its own: a batch that some of its
+// sinks did not take, because they failed or were down, is kept in its place
+// for them only, and the batches after it are still replayed to the others.
+func (e *Exporter) replaySpool(ctx context.Context, down sinkSet) error {
+	if e.spool == nil || len(down) >= len(e.sinks) {
+		return nil
+	}
+
+	var lastErr error
+
+	err := e.spool.Replay(func(record []byte) ([]byte, error) {
+		var b series.Batch
+		if err := json.Unmarshal(record, &b); err != nil {
+			e.logger.Errorf("Discarding unreadable spooled batch: %s", err)
+			return nil, nil
+		}
+
+		remaining, err := e.push(ctx, b, down)
+		if err == nil {
+			return nil, nil
+		}
+
+		if !errors.Is(err, retry.ErrHeld) {
+			lastErr = err
+		}
+
+		if sameTargets(remaining.Targets, b.Targets, e.sinkNames) {
+			return record, nil
+		}
+
+		keep, err := json.Marshal(remaining)
+		if err != nil {
+			e.logger.Errorf("Could not encode series for the spool: %s", err)
+			return record, nil
+		}
+
+		return keep, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return lastErr
+}
+
+// sameTargets reports whether the remaining targets of a batch are all of its
+// original ones, all sinks if there were none.
+func sameTargets(remaining, original, all []string) bool {
+	if len(original) == 0 {
+		original = all
+	}
+
+	if len(remaining) != len(original) {
+		return false
+	}
+
+	set := make(map[string]bool, len(original))
+	for _, name := range original {
+		set[name] = true
+	}
+
+	for _, name := range remaining {
+		if !set[name] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// spoolBatch appends a batch that could not be pushed to the spool. Without a
+// spool the batch is dropped.
+func (e *Exporter) spoolBatch(b series.Batch) {
+	if len(b.Series) == 0 {
+		return
+	}
+
+	if e.spool == nil {
+		e.logger.Warnf("Dropping %d series that could not be exported", len(b.Series))
+		return
+	}
+
+	record, err := json.Marshal(b)
+	if err != nil {
+		e.logger.Errorf("Could not encode series for the spool: %s", err)
+		return
+	}
+
+	if err := e.spool.Append(record); err != nil {
+		e.logger.Errorf("Could not spool %d series: %s", len(b.Series), err)
+	}
+}
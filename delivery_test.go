@@ -0,0 +1,38 @@
+package exporter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRetryConfValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		conf    Conf
+		wantErr error
+	}{
+		{"defaults", Conf{}, nil},
+		{"no jitter", Conf{DisableRetryJitter: true}, nil},
+		{"full jitter", Conf{RetryJitter: 1}, nil},
+		{"negative jitter", Conf{RetryJitter: -0.1}, ErrInvalidRetryConf},
+		{"jitter over 1", Conf{RetryJitter: 1.5}, ErrInvalidRetryConf},
+		{"constant backoff", Conf{RetryBackoffFactor: 1}, nil},
+		{"shrinking backoff", Conf{RetryBackoffFactor: 0.5}, ErrInvalidRetryConf},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := tc.conf
+			conf.Offline = true
+			conf.LogFolder = t.TempDir()
+			conf.LogFile = "exporter.log"
+
+			e, err, _ := New(&conf, "h1", "svc", nil)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("New() error = %v, want %v", err, tc.wantErr)
+			}
+
+			if e != nil {
+				_ = e.Close()
+			}
+		})
+	}
+}
@@ -3,8 +3,11 @@ package exporter
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
 	"os"
+	"sync"
 	"time"
 
 	client "github.com/nm-morais/demmon-client/pkg"
@@ -13,7 +16,12 @@ import (
 	"github.com/nm-morais/demmon-exporter/internal/generic"
 	"github.com/nm-morais/demmon-exporter/internal/lv"
 	"github.com/nm-morais/demmon-exporter/internal/metrics"
+	"github.com/nm-morais/demmon-exporter/internal/retry"
+	"github.com/nm-morais/demmon-exporter/internal/series"
+	"github.com/nm-morais/demmon-exporter/internal/spool"
+	"github.com/nm-morais/demmon-exporter/internal/statsd"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 )
 
 const (
@@ -21,6 +29,25 @@ const (
 	ContentTypeText = "text/plain; charset=utf-8"
 )
 
+const (
+	defaultSpoolMaxBytes       = 64 << 20
+	defaultRetryMaxAttempts    = 5
+	defaultRetryInitialBackoff = time.Second
+	defaultRetryMaxBackoff     = 30 * time.Second
+	defaultRetryBackoffFactor  = 2
+	defaultRetryJitter         = 0.2
+	defaultReconnectMaxBackoff = time.Minute
+	maxRejectedSeries          = 1 << 14
+)
+
+// DropPolicy decides which batch the retry queue discards when it is full.
+type DropPolicy = retry.DropPolicy
+
+const (
+	DropOldest = retry.DropOldest
+	DropNewest = retry.DropNewest
+)
+
 type Conf struct {
 	Silent       bool
 	LogFolder    string
@@ -34,20 +61,170 @@ type Conf struct {
 	DialTimeout         time.Duration
 	RequestTimeout      time.Duration
 	MaxSeriesPerRequest int
+
+	// SpoolFolder enables the on-disk spool: batches that could not be pushed
+	// to demmon are kept there and replayed, in order, before new data.
+	SpoolFolder   string
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+
+	// RetryQueueSize enables the in-memory retry queue, which holds up to this
+	// many failed batches and pushes them again with exponential backoff.
+	// Batches it gives up on are handed to the spool, if there is one. Zero
+	// values of the other Retry fields take their defaults; DisableRetries
+	// limits batches to a single attempt, and DisableRetryJitter makes the
+	// backoff exact. RetryBackoffFactor must be at least 1 and RetryJitter
+	// within [0, 1].
+	RetryQueueSize      int
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryBackoffFactor  float64
+	RetryJitter         float64
+	RetryDropPolicy     DropPolicy
+	DisableRetries      bool
+	DisableRetryJitter  bool
+
+	// OnDisconnect is called when the connection to demmon drops, and
+	// OnReconnect once it has been re-established and the buckets reinstalled.
+	// Redials back off from DialBackoffTime up to ReconnectMaxBackoff.
+	OnDisconnect        func(err error)
+	OnReconnect         func()
+	ReconnectMaxBackoff time.Duration
+
+	// CumulativeHistograms exports histogram buckets as cumulative "le_"
+	// counts instead of per-bucket "bucket_" counts.
+	CumulativeHistograms bool
+
+	// Sinks are destinations every export is pushed to besides demmon. A
+	// failing sink does not hold back the others: only the sinks that failed
+	// get the batch again from the retry queue or the spool, which record
+	// them by name, see NamedSink.
+	Sinks []Sink
+
+	// MaxSeriesPerMetric and MaxSeries cap the number of distinct label sets
+	// held between exports, per metric and in total; zero is unlimited.
+	// Observations of label sets past a cap are folded into a series labelled
+	// __overflow__, or dropped if DropOverflowSeries is set, and the label
+	// sets are counted in Stats.Rejected. The label sets of a collector count
+	// until it is unregistered.
+	MaxSeriesPerMetric int
+	MaxSeries          int
+	DropOverflowSeries bool
+
+	// StatsDAddr switches to the StatsD mode: rather than dialling demmon,
+	// observations are sent to the StatsD agent at this UDP address, with
+	// their labels and the global tags as DogStatsD tags, in datagrams of at
+	// most StatsDMTU bytes. With StatsDStream every observation is sent as it
+	// happens, in datagrams flushed when full or every StatsDFlushInterval,
+	// 100ms by default; otherwise they are aggregated and sent on Export.
+	// Histograms and summaries are sent as StatsDHistogramType lines, "h" or
+	// "ms".
+	StatsDAddr          string
+	StatsDMTU           int
+	StatsDStream        bool
+	StatsDHistogramType string
+	StatsDFlushInterval time.Duration
+
+	// Offline keeps New from dialling demmon, for runs where it cannot be
+	// reached: exports only go to the other sinks, such as the file sink.
+	Offline bool
+
+	// FileSinkFolder adds a FileSink writing every export as JSON lines to
+	// files in this folder. Files are rotated at FileSinkMaxBytes and at most
+	// FileSinkMaxFiles of them are kept, all if zero.
+	FileSinkFolder   string
+	FileSinkMaxBytes int64
+	FileSinkMaxFiles int
+
+	// UninstallBucketsOnClose makes Shutdown uninstall the demmon buckets
+	// this exporter installed. The demmon client has no call to uninstall
+	// buckets yet, so while there are any Shutdown fails with
+	// ErrUninstallUnsupported, after closing everything else.
+	UninstallBucketsOnClose bool
+
+	// UninstallBucketsOnUnregister makes Unregister uninstall the demmon
+	// bucket of the metric. Without a client call to do so, Unregister logs
+	// ErrUninstallUnsupported instead.
+	UninstallBucketsOnUnregister bool
+
+	// GaugeTTL, when non-zero, is how long a gauge keeps being exported after
+	// its last Set or Add. Gauges otherwise keep their value, and are
+	// exported on every tick, for as long as the exporter runs.
+	GaugeTTL time.Duration
+
+	// FuncTimeout bounds how long Export waits for the callbacks of the
+	// metrics created by NewGaugeFunc and NewCounterFunc, unless they are
+	// given their own with WithFuncTimeout. Defaults to 1s.
+	FuncTimeout time.Duration
+
+	// RuntimeMetrics registers a RuntimeCollector, reporting the Go runtime
+	// metrics on every export.
+	RuntimeMetrics bool
+
+	// ProcessMetrics registers a ProcessCollector, reporting the resource
+	// usage of this process from the procfs mounted at ProcRoot, /proc by
+	// default.
+	ProcessMetrics bool
+	ProcRoot       string
+
+	// NodeMetrics registers a NodeCollector, reporting host statistics from
+	// the procfs at ProcRoot, with its devices and interfaces picked by
+	// NodeFilters.
+	NodeMetrics bool
+	NodeFilters NodeFilters
+
+	// CgroupMetrics registers a CgroupCollector, reporting the resources of
+	// the cgroup v2 of this process from the hierarchy mounted at CgroupRoot,
+	// /sys/fs/cgroup by default.
+	CgroupMetrics bool
+	CgroupRoot    string
 }
 
 type Exporter struct {
 	counters   *lv.Space
 	gauges     *lv.Space
-	histBounds map[string][]float64
 	histograms *lv.Space
-	tags       map[string]string
 
-	bucketGranularities map[string]int
+	// boundsMtx rather than mtx guards histBounds, which is read when a
+	// histogram series is created, during an observation
+	boundsMtx  sync.RWMutex
+	histBounds map[string][]float64
 
-	client *client.DemmonClient
-	logger *logrus.Logger
-	conf   *Conf
+	summaries *summaries
+	tags      map[string]string
+
+	// limiter, shared by the stores, also caps the series of collectors
+	limiter *lv.Limiter
+
+	mtx            sync.Mutex
+	metrics        map[string]*metricEntry
+	bucketInterval time.Duration
+	bucketsPending bool
+	installed      map[string]bool
+	funcs          []*funcMetric
+	collectors     []*registeredCollector
+	closed         bool
+	loops          sync.WaitGroup
+	rejected       map[string]map[uint64]struct{}
+	help           map[string]string
+	prom           *promState
+
+	client     *client.DemmonClient
+	statsd     *statsdEmitter
+	timings    *lv.Space
+	fileSink   *FileSink
+	sinks      []Sink
+	sinkNames  []string
+	sinkIdx    map[string]int
+	connected  *atomic.Bool
+	done       chan struct{}
+	exportMtx  sync.Mutex
+	lastExport time.Time
+	spool      *spool.Spool
+	retries    *retry.Queue
+	logger     *logrus.Logger
+	conf       *Conf
 }
 
 func New(confs *Conf, host, service string, tags map[string]string) (*Exporter, error, chan error) {
@@ -67,159 +244,639 @@ func New(confs *Conf, host, service string, tags map[string]string) (*Exporter,
 		confs.MaxSeriesPerRequest = 1000
 	}
 
+	if confs.SpoolMaxBytes == 0 {
+		confs.SpoolMaxBytes = defaultSpoolMaxBytes
+	}
+
+	if err := setRetryDefaults(confs); err != nil {
+		return nil, err, nil
+	}
+
+	if confs.ReconnectMaxBackoff == 0 {
+		confs.ReconnectMaxBackoff = defaultReconnectMaxBackoff
+	}
+
+	if confs.FuncTimeout == 0 {
+		confs.FuncTimeout = defaultFuncTimeout
+	}
+
 	e := &Exporter{
-		counters:            lv.NewSpace(),
-		gauges:              lv.NewSpace(),
-		histograms:          lv.NewSpace(),
-		tags:                tags,
-		logger:              logrus.New(),
-		conf:                confs,
-		bucketGranularities: make(map[string]int),
+		counters:   lv.NewSpaceWith(lv.Sum),
+		gauges:     lv.NewSpaceWith(lv.Last),
+		summaries:  newSummaries(),
+		tags:       tags,
+		logger:     logrus.New(),
+		conf:       confs,
+		histBounds: make(map[string][]float64),
+		metrics:    make(map[string]*metricEntry),
+		installed:  make(map[string]bool),
+		rejected:   make(map[string]map[uint64]struct{}),
+		help:       make(map[string]string),
+		connected:  atomic.NewBool(false),
+		done:       make(chan struct{}),
+		lastExport: time.Now(),
+	}
+
+	e.histograms = lv.NewSpaceWith(e.newHistogramAggregator)
+
+	if confs.MaxSeriesPerMetric > 0 || confs.MaxSeries > 0 {
+		limiter := lv.NewLimiter(confs.MaxSeriesPerMetric, confs.MaxSeries, !confs.DropOverflowSeries)
+		e.limiter = limiter
+		e.counters.SetLimiter(limiter)
+		e.gauges.SetLimiter(limiter)
+		e.histograms.SetLimiter(limiter)
+		e.summaries.limiter = limiter
 	}
 
-	c := client.New(clientConf)
-	e.client = c
+	for _, s := range confs.Sinks {
+		if t, ok := s.(globalTagsSetter); ok {
+			t.setGlobalTags(tags)
+		}
+	}
 
-	var connectErr error
+	e.sinks = confs.Sinks
+
+	if confs.FileSinkFolder != "" {
+		fs, err := NewFileSink(confs.FileSinkFolder, confs.FileSinkMaxBytes, confs.FileSinkMaxFiles)
+		if err != nil {
+			return nil, err, nil
+		}
+
+		e.fileSink = fs
+		e.sinks = append(append([]Sink{}, e.sinks...), fs)
+	}
 
 	var errChan chan error
 
-	for i := 0; i < confs.DialAttempts; i++ {
-		connectErr, errChan = c.ConnectTimeout(confs.DialTimeout)
+	switch {
+	case confs.StatsDAddr != "":
+		s, err := newStatsDEmitter(confs, tags)
+		if err != nil {
+			e.closeOpened()
+			return nil, err, nil
+		}
+
+		e.statsd = s
+
+		if !s.stream {
+			// the raw observations are held until the next Export, so they are
+			// capped like the stores, though under a limiter of their own
+			e.timings = lv.NewSpace()
+
+			if confs.MaxSeriesPerMetric > 0 || confs.MaxSeries > 0 {
+				e.timings.SetLimiter(lv.NewLimiter(confs.MaxSeriesPerMetric, confs.MaxSeries, !confs.DropOverflowSeries))
+			}
+		}
+	case !confs.Offline:
+		c := client.New(clientConf)
+		e.sinks = append([]Sink{&DemmonSink{client: c, connected: e.connected.Load}}, e.sinks...)
+
+		var connectErr error
+
+		for i := 0; i < confs.DialAttempts; i++ {
+			connectErr, errChan = c.ConnectTimeout(confs.DialTimeout)
+			if connectErr != nil {
+				time.Sleep(confs.DialBackoffTime) // sleep and retry
+				continue
+			}
+
+			break
+		}
+
 		if connectErr != nil {
-			time.Sleep(confs.DialBackoffTime) // sleep and retry
-			continue
+			e.closeOpened()
+			return nil, connectErr, errChan
 		}
 
-		break
+		e.client = c
+	}
+
+	names, err := sinkNames(e.sinks)
+	if err != nil {
+		e.closeOpened()
+		return nil, err, nil
 	}
 
-	if connectErr != nil {
-		return nil, connectErr, errChan
+	e.sinkNames = names
+	e.sinkIdx = make(map[string]int, len(names))
+
+	for i, name := range names {
+		e.sinkIdx[name] = i
 	}
 
 	setupLogger(e.logger, e.conf.LogFolder, e.conf.LogFile, e.conf.Silent)
 
+	if confs.SpoolFolder != "" {
+		s, err := spool.Open(confs.SpoolFolder, confs.SpoolMaxBytes, confs.SpoolMaxAge)
+		if err != nil {
+			e.closeOpened()
+			return nil, err, nil
+		}
+
+		e.spool = s
+	}
+
+	if confs.RetryQueueSize > 0 {
+		e.retries = retry.NewQueue(confs.RetryQueueSize, confs.RetryMaxAttempts, retry.Backoff{
+			Initial: confs.RetryInitialBackoff,
+			Max:     confs.RetryMaxBackoff,
+			Factor:  confs.RetryBackoffFactor,
+			Jitter:  confs.RetryJitter,
+		}, confs.RetryDropPolicy)
+	}
+
+	if confs.RuntimeMetrics {
+		if err := e.RegisterCollector(NewRuntimeCollector(confs.CumulativeHistograms), CollectorOpts{}); err != nil {
+			e.closeOpened()
+			return nil, err, nil
+		}
+	}
+
+	if confs.ProcessMetrics {
+		if err := e.RegisterCollector(NewProcessCollector(confs.ProcRoot), CollectorOpts{}); err != nil {
+			e.closeOpened()
+			return nil, err, nil
+		}
+	}
+
+	if confs.NodeMetrics {
+		if err := e.RegisterCollector(NewNodeCollector(confs.ProcRoot, confs.NodeFilters), CollectorOpts{}); err != nil {
+			e.closeOpened()
+			return nil, err, nil
+		}
+	}
+
+	if confs.CgroupMetrics {
+		if err := e.RegisterCollector(NewCgroupCollector(confs.ProcRoot, confs.CgroupRoot), CollectorOpts{}); err != nil {
+			e.closeOpened()
+			return nil, err, nil
+		}
+	}
+
+	if e.client != nil {
+		e.connected.Store(true)
+
+		go e.supervise(errChan)
+	}
+
 	return e, nil, nil
 }
 
-// NewCounter returns an Influx counter.
+// closeOpened disconnects from demmon and closes the emitter, sinks and spool
+// New opened before it failed.
+func (e *Exporter) closeOpened() {
+	if e.client != nil {
+		e.client.Disconnect()
+	}
+
+	if e.statsd != nil {
+		_ = e.statsd.close()
+	}
+
+	if e.fileSink != nil {
+		_ = e.fileSink.Close()
+	}
+
+	if e.spool != nil {
+		_ = e.spool.Close()
+	}
+}
+
+// NewCounter returns a counter whose observations are summed between exports.
+// It panics if name is registered as another kind of metric or with another
+// sample count; see RegisterCounter.
 func (e *Exporter) NewCounter(name string, nrSamplesToStore int) *Counter {
-	e.bucketGranularities[name] = nrSamplesToStore
+	c, err := e.RegisterCounter(name, nrSamplesToStore)
+	if err != nil {
+		e.logger.Panic(err)
+	}
 
-	return &Counter{
+	return c
+}
+
+// RegisterCounter is like NewCounter, but returns an error wrapping
+// ErrMetricConflict instead of panicking. Registering a counter twice returns
+// the same Counter.
+func (e *Exporter) RegisterCounter(name string, nrSamplesToStore int) (*Counter, error) {
+	return e.registerCounter(name, nrSamplesToStore, nil)
+}
+
+func (e *Exporter) registerCounter(name string, nrSamplesToStore int, labels []string) (*Counter, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	m, err := e.registerHandleLocked(MetricInfo{Name: name, Kind: KindCounter, Samples: nrSamplesToStore, Labels: labels})
+	if err != nil {
+		return nil, err
+	}
+
+	if c, ok := m.handle.(*Counter); ok {
+		return c, nil
+	}
+
+	c := &Counter{
 		name: name,
-		obs:  e.counters.Observe,
+		obs:  e.observer(m, e.statsdObserver(e.counters.Observe, statsd.Counter, false)),
 	}
+	m.handle = c
+
+	return c, nil
 }
 
-// NewGauge returns an Influx gauge.
+// NewGauge returns a gauge that exports its last value. It panics if name is
+// registered as another kind of metric or with another sample count; see
+// RegisterGauge.
 func (e *Exporter) NewGauge(name string, nrSamplesToStore int) *Gauge {
-	e.bucketGranularities[name] = nrSamplesToStore
+	g, err := e.RegisterGauge(name, nrSamplesToStore)
+	if err != nil {
+		e.logger.Panic(err)
+	}
 
-	return &Gauge{
+	return g
+}
+
+// RegisterGauge is like NewGauge, but returns an error wrapping
+// ErrMetricConflict instead of panicking. Registering a gauge twice returns
+// the same Gauge.
+func (e *Exporter) RegisterGauge(name string, nrSamplesToStore int) (*Gauge, error) {
+	return e.registerGauge(name, nrSamplesToStore, nil)
+}
+
+func (e *Exporter) registerGauge(name string, nrSamplesToStore int, labels []string) (*Gauge, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	m, err := e.registerHandleLocked(MetricInfo{Name: name, Kind: KindGauge, Samples: nrSamplesToStore, Labels: labels})
+	if err != nil {
+		return nil, err
+	}
+
+	if g, ok := m.handle.(*Gauge); ok {
+		return g, nil
+	}
+
+	g := &Gauge{
 		name: name,
-		obs:  e.gauges.Observe,
-		add:  e.gauges.Add,
+		obs:  e.observer(m, e.statsdObserver(e.gauges.Observe, statsd.Gauge, false)),
+		add:  e.observer(m, e.statsdObserver(e.gauges.Add, statsd.Gauge, true)),
 	}
+	m.handle = g
+
+	return g, nil
 }
 
+// NewHistogram returns a histogram that counts observations into buckets with
+// the given upper bounds. The bounds must be sorted, non-empty and free of
+// duplicates; a +Inf bucket is always added. It panics on invalid bounds, or
+// if name is registered as another kind of metric, with another sample count
+// or with other bounds; see RegisterHistogram.
 func (e *Exporter) NewHistogram(name string, nrSamplesToStore int, upperBucketBounds []float64) *Histogram {
-	e.bucketGranularities[name] = nrSamplesToStore
+	h, err := e.RegisterHistogram(name, nrSamplesToStore, upperBucketBounds)
+	if err != nil {
+		e.logger.Panic(err)
+	}
 
-	return &Histogram{
+	return h
+}
+
+// RegisterHistogram is like NewHistogram, but returns an error instead of
+// panicking. Registering a histogram twice returns the same Histogram.
+func (e *Exporter) RegisterHistogram(name string, nrSamplesToStore int, upperBucketBounds []float64) (*Histogram, error) {
+	return e.registerHistogram(name, nrSamplesToStore, upperBucketBounds, nil)
+}
+
+func (e *Exporter) registerHistogram(name string, nrSamplesToStore int, upperBucketBounds []float64, labels []string) (*Histogram, error) {
+	if err := generic.ValidateBounds(upperBucketBounds); err != nil {
+		return nil, fmt.Errorf("invalid bounds for histogram %s: %w", name, err)
+	}
+
+	bounds := make([]float64, len(upperBucketBounds))
+	copy(bounds, upperBucketBounds)
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	info := MetricInfo{Name: name, Kind: KindHistogram, Samples: nrSamplesToStore, Labels: labels, Bounds: bounds}
+
+	m, err := e.registerHandleLocked(info)
+	if err != nil {
+		return nil, err
+	}
+
+	if h, ok := m.handle.(*Histogram); ok {
+		return h, nil
+	}
+
+	e.boundsMtx.Lock()
+	e.histBounds[name] = bounds
+	e.boundsMtx.Unlock()
+
+	h := &Histogram{
+		name: name,
+		obs:  e.observer(m, e.statsdObserver(e.histograms.Observe, statsd.Histogram, false)),
+	}
+	m.handle = h
+
+	return h, nil
+}
+
+// newHistogramAggregator returns the bucket counts that back a new series of
+// the named histogram.
+func (e *Exporter) newHistogramAggregator(name string) lv.Aggregator {
+	e.boundsMtx.RLock()
+	bounds, ok := e.histBounds[name]
+	e.boundsMtx.RUnlock()
+
+	if !ok {
+		e.logger.Errorf("No bounds for histogram %s", name)
+		bounds = []float64{math.Inf(1)}
+	}
+
+	return generic.NewHistogram(name, bounds)
+}
+
+// NewSummary returns a summary that tracks the given quantiles of its
+// observations, or generic.DefaultQuantiles if none are given. Quantiles are
+// computed over windows that start over at the first export after they are
+// maxAge old, or at every export when maxAge is zero, and the exported series
+// start where their window does. It panics on invalid quantiles, or if name is
+// registered as another kind of metric or with other parameters; see
+// RegisterSummary.
+func (e *Exporter) NewSummary(name string, nrSamplesToStore int, quantiles []float64, maxAge time.Duration) *Summary {
+	s, err := e.RegisterSummary(name, nrSamplesToStore, quantiles, maxAge)
+	if err != nil {
+		e.logger.Panic(err)
+	}
+
+	return s
+}
+
+// RegisterSummary is like NewSummary, but returns an error instead of
+// panicking. Registering a summary twice returns the same Summary.
+func (e *Exporter) RegisterSummary(name string, nrSamplesToStore int, quantiles []float64, maxAge time.Duration) (*Summary, error) {
+	if len(quantiles) == 0 {
+		quantiles = generic.DefaultQuantiles
+	}
+
+	if err := generic.ValidateQuantiles(quantiles); err != nil {
+		return nil, fmt.Errorf("invalid quantiles for summary %s: %w", name, err)
+	}
+
+	quantiles = append([]float64{}, quantiles...)
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	info := MetricInfo{Name: name, Kind: KindSummary, Samples: nrSamplesToStore, Quantiles: quantiles, MaxAge: maxAge}
+
+	m, err := e.registerHandleLocked(info)
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := m.handle.(*Summary); ok {
+		return s, nil
+	}
+
+	e.summaries.register(name, summaryConf{
+		quantiles: quantiles,
+		maxAge:    maxAge,
+	})
+
+	s := &Summary{
 		name: name,
-		obs:  e.histograms.Observe,
+		obs:  e.observer(m, e.statsdObserver(e.summaries.observe, statsd.Histogram, false)),
 	}
+	m.handle = s
+
+	return s, nil
 }
 
+// ExportLoop exports every interval until ctx is done or the exporter is shut
+// down. When ctx is done, what was observed since the last tick is exported
+// one final time, within one interval; Shutdown does its own final export.
 func (e *Exporter) ExportLoop(ctx context.Context, interval time.Duration) {
+	e.mtx.Lock()
+	if e.closed {
+		e.mtx.Unlock()
+		return
+	}
+
+	e.loops.Add(1)
+	defer e.loops.Done()
+
+	e.bucketInterval = interval
+	e.mtx.Unlock()
+
 	e.logger.Info("Starting export loop")
 
-	t := time.NewTicker(interval)
+	e.tryInstallBuckets()
 
-	for bName, bSampleCount := range e.bucketGranularities {
-		e.logger.Info("installing buckets...")
-		err := e.client.InstallBucket(bName, interval, bSampleCount)
+	t := time.NewTicker(interval)
+	defer t.Stop()
 
-		if err != nil {
-			e.logger.Panic(err)
-		}
-	}
+	retryTimer := time.NewTimer(0)
+	defer retryTimer.Stop()
+	<-retryTimer.C
 
 	for {
 		select {
 		case <-t.C:
-			if err := e.Export(); err != nil {
+			e.mtx.Lock()
+			pending := e.bucketsPending
+			e.mtx.Unlock()
+
+			if pending && e.connected.Load() {
+				e.tryInstallBuckets()
+			}
+
+			err := e.export(context.Background())
+			e.scheduleRetry(retryTimer)
+
+			if err != nil {
 				e.logger.Errorf("Error exporting: %s", err)
 				continue
 			}
 
 			e.logger.Trace("Exported metrics successfully")
+		case <-retryTimer.C:
+			if err := e.retryPending(context.Background(), e.downSinks()); err != nil {
+				e.logger.Errorf("Error retrying export: %s", err)
+			}
+
+			e.scheduleRetry(retryTimer)
 		case <-ctx.Done():
 			e.logger.Trace("Context is done")
+			e.finalExport(interval)
+
+			return
+		case <-e.done:
+			e.logger.Trace("Exporter is shut down")
 			return
 		}
 	}
 }
 
+// finalExport exports what was observed since the last tick of an export loop
+// whose context is done, giving up after timeout.
+func (e *Exporter) finalExport(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := e.export(ctx); err != nil {
+		e.logger.Errorf("Error exporting: %s", err)
+	}
+}
+
+// Export pushes the observations collected since the previous export. It
+// fails with ErrClosed once the exporter is shut down.
 func (e *Exporter) Export() (err error) {
+	e.mtx.Lock()
+	closed := e.closed
+	e.mtx.Unlock()
+
+	if closed {
+		return ErrClosed
+	}
+
+	return e.export(context.Background())
+}
+
+func (e *Exporter) export(ctx context.Context) error {
+	e.exportMtx.Lock()
+	defer e.exportMtx.Unlock()
+
 	now := time.Now()
-	bp := []body_types.TimeseriesDTO{}
+	bp := []Series{}
+
+	// the delta series cover the window since the previous export
+	start := e.lastExport
+	e.lastExport = now
 
 	e.logger.Tracef("exporting metrics...")
 
-	e.counters.Reset().Walk(
+	e.collectFuncs()
+	collected := e.gatherCollectors(now)
+
+	counters, histograms := e.resetSpaces()
+
+	if e.conf.GaugeTTL > 0 {
+		e.pruneGauges(now)
+	}
+
+	if e.statsd != nil && !e.statsd.stream {
+		if err := e.statsd.emit(counters, e.gauges, e.timings.Reset()); err != nil {
+			e.logger.Errorf("Error sending to StatsD: %s", err)
+		}
+	}
+
+	counters.Walk(
 		func(name string, lvs lv.LabelValues, values []float64) bool {
 			tags := mergeTags(e.tags, lvs)
 			v := sum(values)
 			fields := map[string]interface{}{"count": v}
-			bp = append(bp, body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now)))
+			dto := body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now))
+			bp = append(bp, Series{Kind: KindCounter, Start: start, TimeseriesDTO: dto})
 			return true
 		},
 	)
 
-	e.gauges.Reset().Walk(
+	e.gauges.Walk(
 		func(name string, lvs lv.LabelValues, values []float64) bool {
 			tags := mergeTags(e.tags, lvs)
 			fields := map[string]interface{}{"value": last(values)}
-			bp = append(bp, body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now)))
+			dto := body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now))
+			bp = append(bp, Series{Kind: KindGauge, TimeseriesDTO: dto})
 			return true
 		},
 	)
 
-	e.histograms.Reset().Walk(
-		func(name string, lvs lv.LabelValues, values []float64) bool {
-			histBounds, ok := e.histBounds[name]
+	histograms.WalkAggregators(
+		func(name string, lvs lv.LabelValues, agg lv.Aggregator) bool {
+			histogram, ok := agg.(*generic.Histogram)
 			if !ok {
-				e.logger.Panicf("No bounds fot histogram %s", name)
+				return true
 			}
-			histogram := generic.NewHistogram(name, histBounds)
 			tags := mergeTags(e.tags, lvs)
-			for _, v := range values {
-				histogram.Observe(v)
-			}
-			fields := histogram.Value()
-			bp = append(bp, body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now)))
+			fields := histogram.Value(e.conf.CumulativeHistograms)
+			dto := body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now))
+			bp = append(bp, Series{Kind: KindHistogram, Start: start, TimeseriesDTO: dto})
 			return true
 		},
 	)
 
-	if len(bp) == 0 {
+	e.summaries.walk(now,
+		func(name string, lvs lv.LabelValues, started time.Time, fields map[string]interface{}) {
+			tags := mergeTags(e.tags, lvs)
+			dto := body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now))
+			bp = append(bp, Series{Kind: KindSummary, Start: started, TimeseriesDTO: dto})
+		},
+	)
+
+	for i := range collected {
+		if collected[i].Kind != KindGauge && collected[i].Kind != KindUntyped && collected[i].Start.IsZero() {
+			collected[i].Start = start
+		}
+	}
+
+	bp = append(bp, collected...)
+
+	// pending batches go first, oldest first: the spool holds those the retry
+	// queue gave up on or evicted. A sink whose pending batches fail is marked
+	// down, and the new series are held back from it so it gets them in order.
+	down := e.downSinks()
+	errs := []error{e.replaySpool(ctx, down), e.retryPending(ctx, down), e.pushSeries(ctx, bp, down)}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneGauges deletes the gauges that were not updated within GaugeTTL.
+func (e *Exporter) pruneGauges(now time.Time) {
+	deadline := now.Add(-e.conf.GaugeTTL)
+
+	e.gauges.Prune(func(name string, lvs lv.LabelValues, agg lv.Aggregator) bool {
+		stamped, ok := agg.(lv.Stamped)
+		return ok && stamped.Updated().Before(deadline)
+	})
+}
+
+// pushSeries pushes bp to every sink that is not down, in chunks of at most
+// MaxSeriesPerRequest. Once a sink fails, it is down for the rest of the
+// call: the chunks it did not get are deferred for it, along with those held
+// back from the sinks that were down already.
+func (e *Exporter) pushSeries(ctx context.Context, bp []Series, down sinkSet) error {
+	if len(e.sinks) == 0 {
 		return nil
 	}
 
+	var lastErr error
+
 	for i := 0; i < len(bp); i += e.conf.MaxSeriesPerRequest {
 		nrToSend := e.conf.MaxSeriesPerRequest
 		if i+nrToSend > len(bp) {
 			nrToSend = len(bp) - i
 		}
-		err := e.client.PushMetricBlob(bp[i : i+nrToSend])
+
+		b := series.Batch{Series: bp[i : i+nrToSend]}
+
+		failed, held, err := e.pushTo(ctx, b, down)
 		if err != nil {
-			return err
+			lastErr = err
+			e.deferSeries(b.Series, failed, true)
+		}
+
+		if len(held) > 0 {
+			e.deferSeries(b.Series, held, false)
 		}
 	}
-	return nil
+
+	return lastErr
 }
 
 type formatter struct {
@@ -288,6 +945,63 @@ func setupLogger(logger *logrus.Logger, logFolder, logFile string, silent bool)
 
 type observeFunc func(name string, lvs lv.LabelValues, value float64)
 
+// storeFunc is the Observe or Add method of a series store.
+type storeFunc func(name string, lvs lv.LabelValues, value float64) error
+
+// observer adapts a storeFunc to an observeFunc of metric m, dropping the
+// observations it rejects and those made after m is unregistered.
+func (e *Exporter) observer(m *metricEntry, f storeFunc) observeFunc {
+	return func(name string, lvs lv.LabelValues, value float64) {
+		m.mtx.RLock()
+		if m.removed {
+			m.mtx.RUnlock()
+			return
+		}
+
+		// reject takes e.mtx, which Unregister holds while waiting for m.mtx
+		err := f(name, lvs, value)
+		m.mtx.RUnlock()
+
+		if err != nil {
+			e.reject(name, lvs, err)
+		}
+	}
+}
+
+// reject records that an observation of the series of the named metric
+// identified by lvs was dropped, or folded into its overflow series. Each
+// series is counted once, up to maxRejectedSeries per metric. A warning is
+// logged the first time it happens to each metric.
+func (e *Exporter) reject(name string, lvs lv.LabelValues, err error) {
+	if canonical, err := lvs.Canonical(); err == nil {
+		lvs = canonical
+	}
+
+	h := fnv.New64a()
+	for _, v := range lvs {
+		_, _ = h.Write([]byte(v))
+		_, _ = h.Write([]byte{0xff})
+	}
+
+	e.mtx.Lock()
+	rejected, ok := e.rejected[name]
+	if !ok {
+		rejected = map[uint64]struct{}{}
+		e.rejected[name] = rejected
+	}
+
+	if len(rejected) < maxRejectedSeries {
+		rejected[h.Sum64()] = struct{}{}
+	}
+
+	first := !ok
+	e.mtx.Unlock()
+
+	if first {
+		e.logger.Warnf("Rejected observation of metric %s: %s", name, err)
+	}
+}
+
 type Counter struct {
 	name string
 	lvs  lv.LabelValues
@@ -295,9 +1009,14 @@ type Counter struct {
 }
 
 func (c *Counter) With(labelValues ...string) exporters.Counter {
+	return c.with(c.lvs.With(labelValues...))
+}
+
+// with returns the counter for the series identified by lvs.
+func (c *Counter) with(lvs lv.LabelValues) *Counter {
 	return &Counter{
 		name: c.name,
-		lvs:  c.lvs.With(labelValues...),
+		lvs:  lvs,
 		obs:  c.obs,
 	}
 }
@@ -315,9 +1034,14 @@ type Gauge struct {
 
 // With implements exporters.Gauge.
 func (g *Gauge) With(labelValues ...string) exporters.Gauge {
+	return g.with(g.lvs.With(labelValues...))
+}
+
+// with returns the gauge for the series identified by lvs.
+func (g *Gauge) with(lvs lv.LabelValues) *Gauge {
 	return &Gauge{
 		name: g.name,
-		lvs:  g.lvs.With(labelValues...),
+		lvs:  lvs,
 		obs:  g.obs,
 		add:  g.add,
 	}
@@ -333,8 +1057,8 @@ func (g *Gauge) Add(delta float64) {
 	g.add(g.name, g.lvs, delta)
 }
 
-// Histogram is an Influx histrogram. Observations are aggregated into a
-// generic.Histogram and emitted as per-quantile gauges to the Influx server.
+// Histogram is a histogram with fixed buckets. Observations are aggregated into a
+// generic.Histogram and emitted as bucket counts, sum and count fields.
 type Histogram struct {
 	name string
 	lvs  lv.LabelValues
@@ -343,9 +1067,14 @@ type Histogram struct {
 
 // With implements metrics.Histogram.
 func (h *Histogram) With(labelValues ...string) metrics.Histogram {
+	return h.with(h.lvs.With(labelValues...))
+}
+
+// with returns the histogram for the series identified by lvs.
+func (h *Histogram) with(lvs lv.LabelValues) *Histogram {
 	return &Histogram{
 		name: h.name,
-		lvs:  h.lvs.With(labelValues...),
+		lvs:  lvs,
 		obs:  h.obs,
 	}
 }
@@ -354,18 +1083,16 @@ func (h *Histogram) Observe(value float64) {
 	h.obs(h.name, h.lvs, value)
 }
 
+// mergeTags returns the global tags overridden by the label values, which come
+// from a series store and are therefore canonical, i.e. paired.
 func mergeTags(tags map[string]string, labelValues []string) map[string]string {
-	if len(labelValues)%2 != 0 {
-		panic("mergeTags received a labelValues with an odd number of strings")
-	}
-
 	ret := make(map[string]string, len(tags)+len(labelValues)/2)
 
 	for k, v := range tags {
 		ret[k] = v
 	}
 
-	for i := 0; i < len(labelValues); i += 2 {
+	for i := 0; i+1 < len(labelValues); i += 2 {
 		ret[labelValues[i]] = labelValues[i+1]
 	}
 
@@ -0,0 +1,280 @@
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nm-morais/demmon-common/body_types"
+)
+
+const (
+	defaultFileSinkMaxBytes = 64 << 20
+
+	seriesFilePrefix     = "series-"
+	seriesFileSuffix     = ".jsonl"
+	seriesFileTimeLayout = "20060102T150405.000000000Z"
+	seriesFilePerms      = 0644
+	maxSeriesLineBytes   = 16 << 20
+)
+
+// SeriesRecord is a line of a file written by FileSink: a single observation
+// of a time series.
+type SeriesRecord struct {
+	Name      string                 `json:"name"`
+	Kind      string                 `json:"kind"`
+	Tags      map[string]string      `json:"tags"`
+	Fields    map[string]interface{} `json:"fields"`
+	Timestamp time.Time              `json:"timestamp"`
+	Start     time.Time              `json:"start"`
+}
+
+// FileSink writes every exported observation as a SeriesRecord, one JSON
+// object per line, to files in a folder, so that runs without demmon can be
+// analysed afterwards or loaded into demmon with LoadSeriesFiles. A new file
+// is started once the current one reaches maxBytes, and only the maxFiles
+// newest files are kept, or all of them if maxFiles is zero.
+type FileSink struct {
+	mtx sync.Mutex
+
+	dir      string
+	maxBytes int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+// NewFileSink returns a sink writing to files in dir, which is created if it
+// does not exist.
+func NewFileSink(dir string, maxBytes int64, maxFiles int) (*FileSink, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultFileSinkMaxBytes
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	return &FileSink{dir: dir, maxBytes: maxBytes, maxFiles: maxFiles}, nil
+}
+
+// Name implements NamedSink.
+func (s *FileSink) Name() string {
+	return "file:" + s.dir
+}
+
+// Push implements Sink.
+func (s *FileSink) Push(ctx context.Context, batch []Series) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var buf []byte
+
+	for i := range batch {
+		for _, obs := range batch[i].Values {
+			line, err := json.Marshal(SeriesRecord{
+				Name:      batch[i].MeasurementName,
+				Kind:      batch[i].Kind.String(),
+				Tags:      batch[i].TSTags,
+				Fields:    obs.Fields,
+				Timestamp: obs.TS,
+				Start:     batch[i].Start,
+			})
+			if err != nil {
+				return err
+			}
+
+			buf = append(append(buf, line...), '\n')
+		}
+	}
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.file == nil || s.size >= s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(buf)
+	s.size += int64(n)
+
+	return err
+}
+
+// Close closes the current file.
+func (s *FileSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+
+		s.file = nil
+	}
+
+	name := seriesFilePrefix + time.Now().UTC().Format(seriesFileTimeLayout) + seriesFileSuffix
+
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, seriesFilePerms)
+	if err != nil {
+		return err
+	}
+
+	s.file = f
+	s.size = 0
+
+	if s.maxFiles <= 0 {
+		return nil
+	}
+
+	files, err := SeriesFiles(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for len(files) > s.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// SeriesFiles returns the paths of the files written by a FileSink in dir,
+// oldest first.
+func SeriesFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, seriesFilePrefix) || !strings.HasSuffix(name, seriesFileSuffix) {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(dir, name))
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// ReadSeriesFile reads back a file written by a FileSink, one series per line.
+// An unreadable last line, which a write cut short by a crash leaves behind,
+// is skipped.
+func ReadSeriesFile(path string) ([]Series, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxSeriesLineBytes)
+
+	bp := []Series{}
+
+	// an unreadable line is only an error if another one follows it
+	var torn error
+
+	for lineNr := 1; sc.Scan(); lineNr++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+
+		if torn != nil {
+			return nil, torn
+		}
+
+		var r SeriesRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			torn = fmt.Errorf("%s:%d: %w", path, lineNr, err)
+			continue
+		}
+
+		dto := body_types.NewTimeseriesDTO(r.Name, r.Tags, body_types.NewObservableDTO(r.Fields, r.Timestamp))
+		bp = append(bp, Series{Kind: parseKind(r.Kind), Start: r.Start, TimeseriesDTO: dto})
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return bp, nil
+}
+
+// LoadSeriesFiles reads the given files, in order, and pushes their series to
+// sink in batches of at most maxSeriesPerRequest, e.g. to demmon through a
+// DemmonSink. Demmon only accepts series of metrics it has a bucket for, so
+// the buckets must have been installed beforehand.
+func LoadSeriesFiles(ctx context.Context, sink Sink, maxSeriesPerRequest int, paths ...string) error {
+	if maxSeriesPerRequest <= 0 {
+		maxSeriesPerRequest = 1000
+	}
+
+	for _, path := range paths {
+		bp, err := ReadSeriesFile(path)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(bp); i += maxSeriesPerRequest {
+			end := i + maxSeriesPerRequest
+			if end > len(bp) {
+				end = len(bp)
+			}
+
+			if err := sink.Push(ctx, bp[i:end]); err != nil {
+				return fmt.Errorf("pushing %s: %w", path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseKind(s string) Kind {
+	for _, k := range []Kind{KindCounter, KindGauge, KindHistogram, KindSummary} {
+		if k.String() == s {
+			return k
+		}
+	}
+
+	return KindUntyped
+}
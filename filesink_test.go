@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSeriesFileTornTail(t *testing.T) {
+	const (
+		first  = `{"name":"requests","kind":"counter","tags":{"host":"h1"},"fields":{"count":1},"timestamp":"2024-01-01T00:00:00Z"}`
+		second = `{"name":"requests","kind":"counter","tags":{"host":"h1"},"fields":{"count":2},"timestamp":"2024-01-01T00:00:01Z"}`
+	)
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{"complete", first + "\n" + second + "\n", 2, false},
+		{"torn last line", first + "\n" + second[:40], 1, false},
+		{"torn last line and newline", first + "\n" + second[:40] + "\n\n", 1, false},
+		{"only a torn line", first[:10], 0, false},
+		{"corrupt line before the last", first[:40] + "\n" + second + "\n", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "series.jsonl")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			bp, err := ReadSeriesFile(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ReadSeriesFile() error = %v, want error %t", err, tc.wantErr)
+			}
+
+			if len(bp) != tc.want {
+				t.Errorf("read %d series, want %d", len(bp), tc.want)
+			}
+
+			if len(bp) > 0 && bp[0].Kind != KindCounter {
+				t.Errorf("kind = %v, want %v", bp[0].Kind, KindCounter)
+			}
+		})
+	}
+}
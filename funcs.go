@@ -0,0 +1,288 @@
+package exporter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+	"github.com/nm-morais/demmon-exporter/internal/statsd"
+	"go.uber.org/atomic"
+)
+
+const defaultFuncTimeout = time.Second
+
+// funcMetric is a gauge or counter whose value is read from a callback on
+// every export.
+type funcMetric struct {
+	name    string
+	lvs     lv.LabelValues
+	fn      func() float64
+	obs     observeFunc
+	counter bool
+	timeout time.Duration
+	last    float64
+	seen    bool
+	running *atomic.Bool
+}
+
+// FuncOption configures a gauge or counter registered with a callback.
+type FuncOption func(*funcMetric)
+
+// WithFuncTimeout bounds how long Export waits for the callback, instead of
+// FuncTimeout.
+func WithFuncTimeout(d time.Duration) FuncOption {
+	return func(f *funcMetric) {
+		if d > 0 {
+			f.timeout = d
+		}
+	}
+}
+
+type funcResult struct {
+	value float64
+	err   error
+	at    time.Time
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn on every export.
+// labelValues are label and value pairs. fn is called with a timeout of
+// FuncTimeout, unless set with WithFuncTimeout, and a call that panics or
+// times out is skipped, along with the value of the previous call, so the
+// gauge is left out until a call succeeds. Registering a series again keeps its first callback.
+// It panics on invalid label values, or if name is registered as another kind
+// of metric, with another sample count or with callbacks for other label keys;
+// see RegisterGaugeFunc.
+func (e *Exporter) NewGaugeFunc(name string, nrSamplesToStore int, labelValues []string, fn func() float64, opts ...FuncOption) {
+	if err := e.RegisterGaugeFunc(name, nrSamplesToStore, labelValues, fn, opts...); err != nil {
+		e.logger.Panic(err)
+	}
+}
+
+// RegisterGaugeFunc is like NewGaugeFunc, but returns an error instead of
+// panicking.
+func (e *Exporter) RegisterGaugeFunc(name string, nrSamplesToStore int, labelValues []string, fn func() float64, opts ...FuncOption) error {
+	store := e.statsdObserver(e.gauges.Observe, statsd.Gauge, false)
+	return e.registerFunc(name, nrSamplesToStore, labelValues, fn, KindGauge, store, opts)
+}
+
+// NewCounterFunc registers a counter that reads a monotonically increasing
+// total from fn on every export, and counts its increase since the previous
+// export. The first total read is only the baseline of the increases, and a
+// total lower than the previous one is taken as a reset of the source. A
+// skipped call leaves the increase to the next one. Calls are made, and errors reported, as in NewGaugeFunc.
+func (e *Exporter) NewCounterFunc(name string, nrSamplesToStore int, labelValues []string, fn func() float64, opts ...FuncOption) {
+	if err := e.RegisterCounterFunc(name, nrSamplesToStore, labelValues, fn, opts...); err != nil {
+		e.logger.Panic(err)
+	}
+}
+
+// RegisterCounterFunc is like NewCounterFunc, but returns an error instead of
+// panicking.
+func (e *Exporter) RegisterCounterFunc(
+	name string, nrSamplesToStore int, labelValues []string, fn func() float64, opts ...FuncOption,
+) error {
+	store := e.statsdObserver(e.counters.Observe, statsd.Counter, false)
+	return e.registerFunc(name, nrSamplesToStore, labelValues, fn, KindCounter, store, opts)
+}
+
+func (e *Exporter) registerFunc(
+	name string, samples int, labelValues []string, fn func() float64, kind Kind, store storeFunc, opts []FuncOption,
+) error {
+	lvs, err := lv.LabelValues(labelValues).Canonical()
+	if err != nil {
+		return fmt.Errorf("invalid label values for metric %s: %w", name, err)
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	labels := make([]string, 0, len(lvs)/2)
+	for i := 0; i < len(lvs); i += 2 {
+		labels = append(labels, lvs[i])
+	}
+
+	m, err := e.registerLocked(MetricInfo{Name: name, Kind: kind, Samples: samples, Labels: labels})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range e.funcs {
+		if f.name != name {
+			continue
+		}
+
+		if keys := f.labelKeys(); !equalStrings(keys, labels) {
+			return fmt.Errorf("%w: %s has label keys %v, not %v", ErrMetricConflict, name, keys, labels)
+		}
+
+		if equalStrings(f.lvs, lvs) {
+			// the series already has a callback, which is kept
+			return nil
+		}
+	}
+
+	f := &funcMetric{
+		name:    name,
+		lvs:     lvs,
+		fn:      fn,
+		obs:     e.observer(m, store),
+		counter: kind == KindCounter,
+		timeout: e.conf.FuncTimeout,
+		running: atomic.NewBool(false),
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	e.funcs = append(e.funcs, f)
+
+	return nil
+}
+
+// collectFuncs calls every callback concurrently and records the values of
+// those that return within their timeout. A callback still running from a
+// previous export is not called again until it returns.
+func (e *Exporter) collectFuncs() {
+	e.mtx.Lock()
+	funcs := make([]*funcMetric, len(e.funcs))
+	copy(funcs, e.funcs)
+	e.mtx.Unlock()
+
+	if len(funcs) == 0 {
+		return
+	}
+
+	start := time.Now()
+	results := make([]chan funcResult, len(funcs))
+
+	for i, f := range funcs {
+		if !f.running.CAS(false, true) {
+			e.logger.Warnf("Skipping metric %s: its callback is still running", f.name)
+			e.dropFuncValue(f)
+
+			continue
+		}
+
+		results[i] = make(chan funcResult, 1)
+
+		go f.call(results[i])
+	}
+
+	for i, f := range funcs {
+		if results[i] == nil {
+			continue
+		}
+
+		deadline := start.Add(f.timeout)
+
+		r, ok := waitFunc(results[i], time.Until(deadline))
+		if !ok || r.at.After(deadline) {
+			e.logger.Warnf("Skipping metric %s: its callback timed out", f.name)
+			e.dropFuncValue(f)
+
+			continue
+		}
+
+		if r.err != nil {
+			e.logger.Errorf("Skipping metric %s: %s", f.name, r.err)
+			e.dropFuncValue(f)
+
+			continue
+		}
+
+		f.record(r.value)
+	}
+}
+
+// dropFuncValue deletes the value an earlier call of a skipped gauge callback
+// left in the gauge store, which would otherwise be exported as current.
+func (e *Exporter) dropFuncValue(f *funcMetric) {
+	if f.counter {
+		return
+	}
+
+	e.gauges.Prune(func(name string, lvs lv.LabelValues, _ lv.Aggregator) bool {
+		return name == f.name && equalStrings(lvs, f.lvs)
+	})
+}
+
+// labelKeys returns the label keys of the series, in canonical order.
+func (f *funcMetric) labelKeys() []string {
+	keys := make([]string, 0, len(f.lvs)/2)
+	for i := 0; i < len(f.lvs); i += 2 {
+		keys = append(keys, f.lvs[i])
+	}
+
+	return keys
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// waitFunc returns the result of a callback, unless it takes longer than
+// remaining.
+func waitFunc(result <-chan funcResult, remaining time.Duration) (funcResult, bool) {
+	if remaining <= 0 {
+		select {
+		case r := <-result:
+			return r, true
+		default:
+			return funcResult{}, false
+		}
+	}
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	select {
+	case r := <-result:
+		return r, true
+	case <-timer.C:
+		return funcResult{}, false
+	}
+}
+
+func (f *funcMetric) call(result chan<- funcResult) {
+	defer f.running.Store(false)
+
+	defer func() {
+		if r := recover(); r != nil {
+			result <- funcResult{err: fmt.Errorf("callback panicked: %v", r), at: time.Now()}
+		}
+	}()
+
+	v := f.fn()
+	result <- funcResult{value: v, at: time.Now()}
+}
+
+func (f *funcMetric) record(value float64) {
+	if !f.counter {
+		f.obs(f.name, f.lvs, value)
+		return
+	}
+
+	if !f.seen {
+		f.last, f.seen = value, true
+		return
+	}
+
+	delta := value - f.last
+	if value < f.last {
+		delta = value
+	}
+
+	f.last = value
+	f.obs(f.name, f.lvs, delta)
+}
@@ -0,0 +1,210 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/influx"
+)
+
+const (
+	// ContentTypeInflux is the content type of line protocol payloads.
+	ContentTypeInflux = "text/plain; charset=utf-8"
+
+	defaultInfluxPayloadSize = 512
+)
+
+// InfluxConf configures an InfluxSink writing to the HTTP /write endpoint.
+type InfluxConf struct {
+	// URL is the base URL of the server, e.g. http://localhost:8086.
+	URL             string
+	Database        string
+	RetentionPolicy string
+	Username        string
+	Password        string
+	Timeout         time.Duration
+	Client          *http.Client
+}
+
+// InfluxSink writes series in the InfluxDB line protocol, with the metric name
+// as measurement, its tags as tags and its fields as fields, either to an
+// Influx-compatible HTTP /write endpoint or to a UDP socket.
+type InfluxSink struct {
+	conf   InfluxConf
+	client *http.Client
+	write  string
+
+	mtx         sync.Mutex
+	conn        net.Conn
+	payloadSize int
+}
+
+// NewInfluxSink returns a sink that POSTs to the /write endpoint under
+// conf.URL.
+func NewInfluxSink(conf InfluxConf) (*InfluxSink, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path = singleJoiningSlash(u.Path, "write")
+
+	q := u.Query()
+	q.Set("db", conf.Database)
+	q.Set("precision", "ns")
+
+	if conf.RetentionPolicy != "" {
+		q.Set("rp", conf.RetentionPolicy)
+	}
+
+	u.RawQuery = q.Encode()
+
+	c := conf.Client
+	if c == nil {
+		c = &http.Client{Timeout: conf.Timeout}
+	}
+
+	return &InfluxSink{conf: conf, client: c, write: u.String()}, nil
+}
+
+// NewInfluxUDPSink returns a sink that writes to the Influx UDP listener at
+// addr, packing lines into datagrams of at most payloadSize bytes. A
+// payloadSize of 0 means 512 bytes.
+func NewInfluxUDPSink(addr string, payloadSize int) (*InfluxSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if payloadSize <= 0 {
+		payloadSize = defaultInfluxPayloadSize
+	}
+
+	return &InfluxSink{conn: conn, payloadSize: payloadSize}, nil
+}
+
+// Name implements NamedSink.
+func (s *InfluxSink) Name() string {
+	if s.conn != nil {
+		return "influx-udp:" + s.conn.RemoteAddr().String()
+	}
+
+	return "influx:" + s.conf.URL
+}
+
+// Push implements Sink.
+func (s *InfluxSink) Push(ctx context.Context, batch []Series) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.conn != nil {
+		return s.pushUDP(batch)
+	}
+
+	return s.pushHTTP(ctx, batch)
+}
+
+// Close closes the UDP socket, if any.
+func (s *InfluxSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.Close()
+}
+
+func (s *InfluxSink) pushHTTP(ctx context.Context, batch []Series) error {
+	var buf []byte
+
+	for i := range batch {
+		for _, obs := range batch[i].Values {
+			buf = influx.AppendLine(buf, batch[i].MeasurementName, batch[i].TSTags, obs.Fields, obs.TS)
+		}
+	}
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if s.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.conf.Timeout)
+
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.write, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", ContentTypeInflux)
+
+	if s.conf.Username != "" || s.conf.Password != "" {
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("influx write to %s returned %s: %s", s.conf.URL, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// pushUDP writes whole lines only, so a line longer than the payload size is
+// sent in a datagram of its own.
+func (s *InfluxSink) pushUDP(batch []Series) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var datagram, line []byte
+
+	for i := range batch {
+		for _, obs := range batch[i].Values {
+			line = influx.AppendLine(line[:0], batch[i].MeasurementName, batch[i].TSTags, obs.Fields, obs.TS)
+
+			if len(datagram) > 0 && len(datagram)+len(line) > s.payloadSize {
+				if _, err := s.conn.Write(datagram); err != nil {
+					return err
+				}
+
+				datagram = datagram[:0]
+			}
+
+			datagram = append(datagram, line...)
+		}
+	}
+
+	if len(datagram) == 0 {
+		return nil
+	}
+
+	_, err := s.conn.Write(datagram)
+
+	return err
+}
+
+func singleJoiningSlash(a, b string) string {
+	if len(a) > 0 && a[len(a)-1] == '/' {
+		return a + b
+	}
+
+	return a + "/" + b
+}
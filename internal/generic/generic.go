@@ -1,14 +1,106 @@
 package generic
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 
 	"go.uber.org/atomic"
 )
 
 const defaultHistIncrement = 1.0
 
+const (
+	// SumField and CountField hold the sum and the number of the observations
+	// summarised by a histogram.
+	SumField   = "sum"
+	CountField = "count"
+
+	bucketFieldPrefix     = "bucket_"
+	cumulativeFieldPrefix = "le_"
+	infBound              = "+Inf"
+)
+
+var (
+	ErrNoBounds       = errors.New("histogram has no bucket bounds")
+	ErrInvalidBound   = errors.New("histogram bucket bound is NaN")
+	ErrUnsortedBounds = errors.New("histogram bucket bounds are not sorted")
+	ErrDuplicateBound = errors.New("histogram bucket bounds contain duplicates")
+)
+
+// ValidateBounds checks that upperBounds is non-empty, sorted in increasing
+// order and free of duplicates.
+func ValidateBounds(upperBounds []float64) error {
+	if len(upperBounds) == 0 {
+		return ErrNoBounds
+	}
+
+	for i, b := range upperBounds {
+		if math.IsNaN(b) {
+			return ErrInvalidBound
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		if b == upperBounds[i-1] {
+			return fmt.Errorf("%w: %v", ErrDuplicateBound, b)
+		}
+
+		if b < upperBounds[i-1] {
+			return fmt.Errorf("%w: %v after %v", ErrUnsortedBounds, b, upperBounds[i-1])
+		}
+	}
+
+	return nil
+}
+
+// BucketField returns the field name under which the bucket with the given
+// upper bound is exported. Cumulative buckets count every observation less
+// than or equal to the bound, per-bucket ones only those above the previous
+// bound.
+func BucketField(upper float64, cumulative bool) string {
+	bound := infBound
+	if !math.IsInf(upper, 1) {
+		bound = strconv.FormatFloat(upper, 'g', -1, 64)
+	}
+
+	if cumulative {
+		return cumulativeFieldPrefix + bound
+	}
+
+	return bucketFieldPrefix + bound
+}
+
+// ParseBucketField is the inverse of BucketField. ok is false for fields that
+// do not name a bucket, such as SumField and CountField.
+func ParseBucketField(field string) (upper float64, cumulative, ok bool) {
+	var bound string
+
+	switch {
+	case strings.HasPrefix(field, cumulativeFieldPrefix):
+		bound, cumulative = strings.TrimPrefix(field, cumulativeFieldPrefix), true
+	case strings.HasPrefix(field, bucketFieldPrefix):
+		bound = strings.TrimPrefix(field, bucketFieldPrefix)
+	default:
+		return 0, false, false
+	}
+
+	if bound == infBound {
+		return math.Inf(1), cumulative, true
+	}
+
+	upper, err := strconv.ParseFloat(bound, 64)
+	if err != nil {
+		return 0, false, false
+	}
+
+	return upper, cumulative, true
+}
+
 type bucket struct {
 	atomic.Float64
 	upper float64 // bucket upper bound, inclusive
@@ -22,8 +114,8 @@ func NewBuckets(upperBounds []float64) Buckets {
 		bs = append(bs, &bucket{upper: upper})
 	}
 
-	if upperBounds[len(upperBounds)-1] != math.MaxFloat64 {
-		bs = append(bs, &bucket{upper: math.MaxFloat64})
+	if !math.IsInf(upperBounds[len(upperBounds)-1], 1) {
+		bs = append(bs, &bucket{upper: math.Inf(1)})
 	}
 
 	return bs
@@ -42,17 +134,30 @@ func (bs Buckets) get(val float64) *bucket {
 		}
 	}
 
+	if i == len(bs) {
+		// only NaN gets here, count it in the +Inf bucket
+		i--
+	}
+
 	return bs[i]
 }
 
+// Histogram counts observations into buckets with fixed upper bounds, and
+// keeps the sum and number of observations.
 type Histogram struct {
 	Name    string
 	Bounds  []float64
 	Buckets Buckets
+
+	sum   atomic.Float64
+	count atomic.Uint64
 }
 
+// NewHistogram returns a histogram with the given bucket upper bounds, which
+// must be valid according to ValidateBounds. A +Inf bucket is always added.
 func NewHistogram(name string, uppers []float64) *Histogram {
 	return &Histogram{
+		Name:    name,
 		Buckets: NewBuckets(uppers),
 		Bounds:  uppers,
 	}
@@ -64,23 +169,57 @@ func (h *Histogram) Observe(value float64) {
 	}
 
 	h.IncBucket(value)
+	h.sum.Add(value)
+	h.count.Inc()
 }
 
-func (h *Histogram) Value() map[string]interface{} {
-	values := make(map[string]interface{})
+// Add is the same as Observe: a histogram has no current value to add to.
+func (h *Histogram) Add(delta float64) {
+	h.Observe(delta)
+}
 
-	for idx, b := range h.Buckets {
-		if idx == 0 {
-			continue
+// Value returns the bucket counts, keyed by BucketField, along with SumField
+// and CountField. With cumulative set, each bucket also counts the
+// observations of the buckets below it.
+func (h *Histogram) Value(cumulative bool) map[string]interface{} {
+	values := make(map[string]interface{}, len(h.Buckets)+2)
+
+	var acc float64
+
+	for _, b := range h.Buckets {
+		v := b.Load()
+
+		if cumulative {
+			acc += v
+			v = acc
 		}
 
-		tag := fmt.Sprintf("%f-%f", h.Buckets[idx-1].upper, b.upper)
-		values[tag] = b.Load()
+		values[BucketField(b.upper, cumulative)] = v
 	}
 
+	values[SumField] = h.sum.Load()
+	values[CountField] = float64(h.count.Load())
+
 	return values
 }
 
+// Snapshot returns the upper bounds of the buckets, ending with +Inf, the
+// cumulative count of each bucket, and the sum and number of observations.
+func (h *Histogram) Snapshot() (uppers, cumulative []float64, sum, count float64) {
+	uppers = make([]float64, 0, len(h.Buckets))
+	cumulative = make([]float64, 0, len(h.Buckets))
+
+	var acc float64
+
+	for _, b := range h.Buckets {
+		acc += b.Load()
+		uppers = append(uppers, b.upper)
+		cumulative = append(cumulative, acc)
+	}
+
+	return uppers, cumulative, h.sum.Load(), float64(h.count.Load())
+}
+
 func (h *Histogram) IncBucket(n float64) {
 	if h == nil {
 		return
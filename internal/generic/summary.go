@@ -0,0 +1,148 @@
+package generic
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nm-morais/demmon-exporter/internal/quantile"
+)
+
+const (
+	MinField = "min"
+	MaxField = "max"
+)
+
+// DefaultQuantiles are the quantiles tracked by a summary created without any.
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+var ErrInvalidQuantile = errors.New("summary quantile must be in (0, 1)")
+
+// ValidateQuantiles checks that every quantile lies strictly between 0 and 1.
+func ValidateQuantiles(quantiles []float64) error {
+	for _, q := range quantiles {
+		if !(q > 0 && q < 1) {
+			return ErrInvalidQuantile
+		}
+	}
+
+	return nil
+}
+
+// QuantileField returns the field name under which quantile q is exported,
+// e.g. "p99" for 0.99.
+func QuantileField(q float64) string {
+	return "p" + strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+}
+
+// ParseQuantileField is the inverse of QuantileField. ok is false for fields
+// that do not name a quantile.
+func ParseQuantileField(field string) (q float64, ok bool) {
+	if !strings.HasPrefix(field, "p") {
+		return 0, false
+	}
+
+	percentile, err := strconv.ParseFloat(strings.TrimPrefix(field, "p"), 64)
+	if err != nil || percentile <= 0 || percentile >= 100 {
+		return 0, false
+	}
+
+	return math.Round(percentile*1e4) / 1e6, true
+}
+
+// Summary tracks streaming quantiles of its observations, together with their
+// count, sum, minimum and maximum, in bounded memory.
+type Summary struct {
+	mtx       sync.Mutex
+	quantiles []float64
+	stream    *quantile.Stream
+	count     uint64
+	sum       float64
+	min       float64
+	max       float64
+	total     uint64
+	totalSum  float64
+}
+
+// NewSummary returns a summary tracking the given quantiles. The allowed rank
+// error of each quantile q is (1-q)/10, so tail quantiles are the most exact.
+func NewSummary(quantiles []float64) *Summary {
+	targets := make([]quantile.Target, 0, len(quantiles))
+	for _, q := range quantiles {
+		targets = append(targets, quantile.Target{Quantile: q, Epsilon: (1 - q) / 10})
+	}
+
+	return &Summary{
+		quantiles: quantiles,
+		stream:    quantile.NewTargeted(targets),
+	}
+}
+
+func (s *Summary) Observe(value float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.stream.Insert(value)
+
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+
+	s.count++
+	s.sum += value
+	s.total++
+	s.totalSum += value
+}
+
+// Count returns the number of observations since the last Reset.
+func (s *Summary) Count() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.count
+}
+
+// Value returns the tracked quantiles, keyed by QuantileField, along with
+// CountField, SumField, MinField and MaxField.
+func (s *Summary) Value() map[string]interface{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	values := make(map[string]interface{}, len(s.quantiles)+4)
+	for _, q := range s.quantiles {
+		values[QuantileField(q)] = s.stream.Query(q)
+	}
+
+	values[CountField] = float64(s.count)
+	values[SumField] = s.sum
+	values[MinField] = s.min
+	values[MaxField] = s.max
+
+	return values
+}
+
+// Totals returns the number and sum of every observation, which Reset keeps.
+func (s *Summary) Totals() (count uint64, sum float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.total, s.totalSum
+}
+
+// Reset discards every observation, apart from their totals.
+func (s *Summary) Reset() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.stream.Reset()
+	s.count = 0
+	s.sum = 0
+	s.min = 0
+	s.max = 0
+}
@@ -0,0 +1,113 @@
+// Package influx encodes time series in the InfluxDB line protocol.
+package influx
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// AppendLine appends the line protocol encoding of one point, terminated by a
+// newline, to buf. Tags are written sorted by key and tags with empty values
+// are left out. Fields whose values cannot be represented, such as NaN and
+// infinities, are skipped; if no field is left, buf is returned unchanged.
+func AppendLine(buf []byte, measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) []byte {
+	start := len(buf)
+
+	buf = append(buf, measurementEscaper.Replace(measurement)...)
+
+	for _, k := range sortedKeys(tags) {
+		if k == "" || tags[k] == "" {
+			continue
+		}
+
+		buf = append(buf, ',')
+		buf = append(buf, keyEscaper.Replace(k)...)
+		buf = append(buf, '=')
+		buf = append(buf, keyEscaper.Replace(tags[k])...)
+	}
+
+	sep := byte(' ')
+	written := 0
+
+	for _, k := range sortedFieldKeys(fields) {
+		value, ok := appendFieldValue(nil, fields[k])
+		if !ok {
+			continue
+		}
+
+		buf = append(buf, sep)
+		buf = append(buf, keyEscaper.Replace(k)...)
+		buf = append(buf, '=')
+		buf = append(buf, value...)
+		sep = ','
+		written++
+	}
+
+	if written == 0 {
+		return buf[:start]
+	}
+
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, ts.UnixNano(), 10)
+
+	return append(buf, '\n')
+}
+
+func appendFieldValue(buf []byte, v interface{}) ([]byte, bool) {
+	switch n := v.(type) {
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return buf, false
+		}
+
+		return strconv.AppendFloat(buf, n, 'f', -1, 64), true
+	case float32:
+		return appendFieldValue(buf, float64(n))
+	case int:
+		return append(strconv.AppendInt(buf, int64(n), 10), 'i'), true
+	case int64:
+		return append(strconv.AppendInt(buf, n, 10), 'i'), true
+	case uint64:
+		return append(strconv.AppendUint(buf, n, 10), 'u'), true
+	case bool:
+		return strconv.AppendBool(buf, n), true
+	case string:
+		buf = append(buf, '"')
+		buf = append(buf, stringEscaper.Replace(n)...)
+
+		return append(buf, '"'), true
+	}
+
+	return buf, false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedFieldKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
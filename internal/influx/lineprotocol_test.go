@@ -0,0 +1,100 @@
+package influx
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAppendLine(t *testing.T) {
+	ts := time.Unix(1, 0)
+
+	for _, tc := range []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		fields      map[string]interface{}
+		want        string
+	}{
+		{
+			name:        "plain",
+			measurement: "cpu",
+			tags:        map[string]string{"host": "h1"},
+			fields:      map[string]interface{}{"value": 1.5},
+			want:        "cpu,host=h1 value=1.5 1000000000\n",
+		},
+		{
+			name:        "measurement",
+			measurement: "cpu load,total\nnow",
+			fields:      map[string]interface{}{"value": 1.0},
+			want:        `cpu\ load\,total\nnow value=1 1000000000` + "\n",
+		},
+		{
+			name:        "measurement keeps equals signs",
+			measurement: "a=b",
+			fields:      map[string]interface{}{"value": 1.0},
+			want:        "a=b value=1 1000000000\n",
+		},
+		{
+			name:        "tag keys and values",
+			measurement: "m",
+			tags:        map[string]string{"a b": "c=d,e", "k\nl": "v w"},
+			fields:      map[string]interface{}{"value": 1.0},
+			want:        `m,a\ b=c\=d\,e,k\nl=v\ w value=1 1000000000` + "\n",
+		},
+		{
+			name:        "empty tags",
+			measurement: "m",
+			tags:        map[string]string{"empty": "", "": "no key", "kept": "v"},
+			fields:      map[string]interface{}{"value": 1.0},
+			want:        "m,kept=v value=1 1000000000\n",
+		},
+		{
+			name:        "sorted",
+			measurement: "m",
+			tags:        map[string]string{"b": "2", "a": "1"},
+			fields:      map[string]interface{}{"y": 2.0, "x": 1.0},
+			want:        "m,a=1,b=2 x=1,y=2 1000000000\n",
+		},
+		{
+			name:        "field keys",
+			measurement: "m",
+			fields:      map[string]interface{}{"x=y z,w": 1.0},
+			want:        `m x\=y\ z\,w=1 1000000000` + "\n",
+		},
+		{
+			name:        "string field",
+			measurement: "m",
+			fields:      map[string]interface{}{"msg": `say "hi" \o/`},
+			want:        `m msg="say \"hi\" \\o/" 1000000000` + "\n",
+		},
+		{
+			name:        "field types",
+			measurement: "m",
+			fields:      map[string]interface{}{"a": 3, "b": int64(-4), "c": uint64(5), "d": true, "e": float32(0.5)},
+			want:        "m a=3i,b=-4i,c=5u,d=true,e=0.5 1000000000\n",
+		},
+		{
+			name:        "unrepresentable fields",
+			measurement: "m",
+			fields:      map[string]interface{}{"nan": math.NaN(), "inf": math.Inf(-1), "struct": struct{}{}, "ok": 1.0},
+			want:        "m ok=1 1000000000\n",
+		},
+		{
+			name:        "no fields left",
+			measurement: "m",
+			tags:        map[string]string{"host": "h1"},
+			fields:      map[string]interface{}{"nan": math.NaN()},
+			want:        "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := []byte("prefix\n")
+
+			got := string(AppendLine(buf, tc.measurement, tc.tags, tc.fields, ts))
+			if got != "prefix\n"+tc.want {
+				t.Errorf("AppendLine() = %q, want %q", got, "prefix\n"+tc.want)
+			}
+		})
+	}
+}
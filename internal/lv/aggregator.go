@@ -0,0 +1,102 @@
+package lv
+
+import "time"
+
+// Aggregator folds the observations of a single time series into whatever
+// state the metric needs, so a series can be observed any number of times
+// between exports in bounded memory.
+type Aggregator interface {
+	Observe(value float64)
+	Add(delta float64)
+}
+
+// Observer is implemented by aggregators whose state can be expressed as a
+// list of observations, which is what Space.Walk hands out.
+type Observer interface {
+	Observations() []float64
+}
+
+// Stamped is implemented by aggregators that know when they were last
+// updated, which Space.Prune can use to find stale series.
+type Stamped interface {
+	Updated() time.Time
+}
+
+// Raw keeps every observation. It is the storage mode of NewSpace, and the
+// only one whose memory grows with the number of observations.
+func Raw(string) Aggregator {
+	return &raw{}
+}
+
+// Sum keeps the running sum of the observations, as needed by counters.
+func Sum(string) Aggregator {
+	return &sum{}
+}
+
+// Last keeps the most recent observation, and when it was made, as needed by
+// gauges.
+func Last(string) Aggregator {
+	return &lastValue{}
+}
+
+type raw struct {
+	observations []float64
+}
+
+func (r *raw) Observe(value float64) {
+	r.observations = append(r.observations, value)
+}
+
+func (r *raw) Add(delta float64) {
+	var value float64
+	if len(r.observations) > 0 {
+		value = last(r.observations) + delta
+	} else {
+		value = delta
+	}
+
+	r.observations = append(r.observations, value)
+}
+
+func (r *raw) Observations() []float64 {
+	return r.observations
+}
+
+type sum struct {
+	value float64
+}
+
+func (s *sum) Observe(value float64) {
+	s.value += value
+}
+
+func (s *sum) Add(delta float64) {
+	s.value += delta
+}
+
+func (s *sum) Observations() []float64 {
+	return []float64{s.value}
+}
+
+type lastValue struct {
+	value   float64
+	updated time.Time
+}
+
+func (l *lastValue) Observe(value float64) {
+	l.value = value
+	l.updated = time.Now()
+}
+
+func (l *lastValue) Add(delta float64) {
+	l.value += delta
+	l.updated = time.Now()
+}
+
+func (l *lastValue) Updated() time.Time {
+	return l.updated
+}
+
+func (l *lastValue) Observations() []float64 {
+	return []float64{l.value}
+}
@@ -1,15 +1,70 @@
 package lv
 
-// LabelValues is a type alias that provides validation on its With method.
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrOddLabelValues = errors.New("odd number of label values")
+	ErrDuplicateLabel = errors.New("duplicate label")
+)
+
+// LabelValues is a type alias that provides validation on its Canonical method.
 // Metrics may include it as a member to help them satisfy With semantics and
 // save some code duplication.
 type LabelValues []string
 
-// With validates the input, and returns a new aggregate labelValues.
+// With returns a new aggregate labelValues. An odd number of label values is
+// kept as is and rejected by Canonical, rather than padded.
 func (lvs LabelValues) With(labelValues ...string) LabelValues {
-	if len(labelValues)%2 != 0 {
-		labelValues = append(labelValues, "unknown")
+	aggregate := make(LabelValues, 0, len(lvs)+len(labelValues))
+	aggregate = append(aggregate, lvs...)
+
+	return append(aggregate, labelValues...)
+}
+
+// Canonical returns the label values with their pairs sorted by label, so
+// that the same set of labels identifies the same time series whatever order
+// it was given in. Odd label values and repeated labels are rejected.
+func (lvs LabelValues) Canonical() (LabelValues, error) {
+	if len(lvs)%2 != 0 {
+		return nil, ErrOddLabelValues
+	}
+
+	sorted := true
+
+	for i := 2; i < len(lvs); i += 2 {
+		if lvs[i] == lvs[i-2] {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicateLabel, lvs[i])
+		}
+
+		if lvs[i] < lvs[i-2] {
+			sorted = false
+		}
+	}
+
+	if sorted {
+		return lvs, nil
+	}
+
+	pairs := make([]pair, 0, len(lvs)/2)
+	for i := 0; i < len(lvs); i += 2 {
+		pairs = append(pairs, pair{lvs[i], lvs[i+1]})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].label < pairs[j].label })
+
+	canonical := make(LabelValues, 0, len(lvs))
+
+	for i, p := range pairs {
+		if i > 0 && p.label == pairs[i-1].label {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicateLabel, p.label)
+		}
+
+		canonical = append(canonical, p.label, p.value)
 	}
 
-	return append(lvs, labelValues...)
+	return canonical, nil
 }
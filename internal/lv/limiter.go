@@ -0,0 +1,90 @@
+package lv
+
+import (
+	"errors"
+	"sync"
+)
+
+// OverflowLabel is the label of the series into which a Limiter folds the
+// series it does not admit.
+const OverflowLabel = "__overflow__"
+
+var (
+	// ErrSeriesDropped is returned for observations of a series that was not
+	// admitted by the space's Limiter.
+	ErrSeriesDropped = errors.New("series limit reached, observation dropped")
+	// ErrSeriesFolded is returned, after the observation was recorded, for
+	// observations folded into the overflow series by the space's Limiter.
+	ErrSeriesFolded = errors.New("series limit reached, observation folded into the " + OverflowLabel + " series")
+)
+
+// OverflowLabelValues identify the overflow series of a metric.
+var OverflowLabelValues = LabelValues{OverflowLabel, "true"}
+
+// IsOverflow reports whether lvs identify the overflow series, which a
+// Limiter does not count.
+func IsOverflow(lvs LabelValues) bool {
+	return len(lvs) == len(OverflowLabelValues) && lvs[0] == OverflowLabelValues[0] && lvs[1] == OverflowLabelValues[1]
+}
+
+// Limiter caps the number of distinct series, per metric name and in total,
+// held by the spaces that share it. Zero caps are unlimited.
+type Limiter struct {
+	mtx        sync.Mutex
+	maxPerName int
+	maxTotal   int
+	fold       bool
+	perName    map[string]int
+	total      int
+}
+
+// NewLimiter returns a Limiter with the given caps. With fold set, the series
+// it does not admit are folded into a single overflow series per metric
+// instead of being dropped.
+func NewLimiter(maxPerName, maxTotal int, fold bool) *Limiter {
+	return &Limiter{
+		maxPerName: maxPerName,
+		maxTotal:   maxTotal,
+		fold:       fold,
+		perName:    map[string]int{},
+	}
+}
+
+// Admit reserves room for a new series of the named metric, and returns false
+// if either cap has been reached.
+func (l *Limiter) Admit(name string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.maxPerName > 0 && l.perName[name] >= l.maxPerName {
+		return false
+	}
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+
+	l.perName[name]++
+	l.total++
+
+	return true
+}
+
+// Release gives back the room taken by n series of the named metric.
+func (l *Limiter) Release(name string, n int) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.perName[name] -= n
+	l.total -= n
+
+	if l.perName[name] <= 0 {
+		delete(l.perName, name)
+	}
+}
+
+// Fold reports whether series that are not admitted are folded into the
+// overflow series rather than dropped.
+func (l *Limiter) Fold() bool {
+	return l.fold
+}
@@ -0,0 +1,120 @@
+package lv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrUnknownLabel = errors.New("label not declared in schema")
+	ErrMissingLabel = errors.New("label declared in schema but missing")
+	ErrLabelCount   = errors.New("wrong number of label values")
+	ErrInvalidLabel = errors.New("invalid label key")
+)
+
+// LabelError describes label values that do not match a metric's schema.
+type LabelError struct {
+	Metric string
+	Label  string
+	Err    error
+}
+
+func (e *LabelError) Error() string {
+	if e.Label == "" {
+		return fmt.Sprintf("metric %s: %s", e.Metric, e.Err)
+	}
+
+	return fmt.Sprintf("metric %s: %s: %q", e.Metric, e.Err, e.Label)
+}
+
+func (e *LabelError) Unwrap() error {
+	return e.Err
+}
+
+// Schema is the set of label keys a metric declares up front. Label values
+// checked against a schema always come out in canonical order.
+type Schema struct {
+	metric string
+	keys   []string
+	order  []int // indexes into keys, in label order
+}
+
+// NewSchema returns the schema of the named metric with the given label keys,
+// which must be non-empty and unique.
+func NewSchema(metric string, keys []string) (*Schema, error) {
+	s := &Schema{
+		metric: metric,
+		keys:   append([]string{}, keys...),
+		order:  make([]int, len(keys)),
+	}
+
+	for i := range s.order {
+		s.order[i] = i
+	}
+
+	sort.Slice(s.order, func(i, j int) bool { return s.keys[s.order[i]] < s.keys[s.order[j]] })
+
+	for i, idx := range s.order {
+		if s.keys[idx] == "" {
+			return nil, &LabelError{Metric: metric, Err: ErrInvalidLabel}
+		}
+
+		if i > 0 && s.keys[idx] == s.keys[s.order[i-1]] {
+			return nil, &LabelError{Metric: metric, Label: s.keys[idx], Err: ErrDuplicateLabel}
+		}
+	}
+
+	return s, nil
+}
+
+// Keys returns the label keys in the order they were declared.
+func (s *Schema) Keys() []string {
+	return append([]string{}, s.keys...)
+}
+
+// LabelValues pairs the values, given in the order the keys were declared,
+// with their keys.
+func (s *Schema) LabelValues(values ...string) (LabelValues, error) {
+	if len(values) != len(s.keys) {
+		return nil, &LabelError{Metric: s.metric, Err: ErrLabelCount}
+	}
+
+	lvs := make(LabelValues, 0, 2*len(values))
+	for _, idx := range s.order {
+		lvs = append(lvs, s.keys[idx], values[idx])
+	}
+
+	return lvs, nil
+}
+
+// Validate checks that the label/value pairs in lvs set exactly the declared
+// keys, and returns them in canonical order.
+func (s *Schema) Validate(lvs LabelValues) (LabelValues, error) {
+	canonical, err := lvs.Canonical()
+	if err != nil {
+		return nil, &LabelError{Metric: s.metric, Err: err}
+	}
+
+	i := 0
+
+	for _, idx := range s.order {
+		key := s.keys[idx]
+
+		if i >= len(canonical) || canonical[i] > key {
+			return nil, &LabelError{Metric: s.metric, Label: key, Err: ErrMissingLabel}
+		}
+
+		if canonical[i] < key {
+			return nil, &LabelError{Metric: s.metric, Label: canonical[i], Err: ErrUnknownLabel}
+		}
+
+		i += 2
+	}
+
+	if i < len(canonical) {
+		return nil, &LabelError{Metric: s.metric, Label: canonical[i], Err: ErrUnknownLabel}
+	}
+
+	return canonical, nil
+}
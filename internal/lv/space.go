@@ -4,17 +4,41 @@ import "sync"
 
 const minLabelValues = 2
 
-// NewSpace returns an N-dimensional vector space.
+// NewSpace returns an N-dimensional vector space that keeps every
+// observation until the next Reset.
 func NewSpace() *Space {
-	return &Space{}
+	return NewSpaceWith(Raw)
+}
+
+// NewSpaceWith returns an N-dimensional vector space whose time series store
+// their observations in the aggregators returned by newAggregator, which is
+// called with the metric name of each new series.
+func NewSpaceWith(newAggregator func(name string) Aggregator) *Space {
+	return &Space{newAggregator: newAggregator}
 }
 
 // Space represents an N-dimensional vector space. Each name and unique label
-// value pair establishes a new dimension and point within that dimension. Order
-// matters, i.e. [a=1 b=2] identifies a different timeseries than [b=2 a=1].
+// value pair establishes a new dimension and point within that dimension. Label
+// values are canonicalised before use, so order does not matter, i.e. [a=1 b=2]
+// and [b=2 a=1] identify the same timeseries.
 type Space struct {
-	mtx   sync.RWMutex
-	nodes map[string]*node
+	mtx           sync.RWMutex
+	nodes         map[string]*node
+	newAggregator func(name string) Aggregator
+
+	admitMtx sync.Mutex
+	limiter  *Limiter
+	series   map[string]int
+}
+
+// SetLimiter caps the number of distinct series in the space. Observations of
+// series that are not admitted are folded or dropped, as the limiter decides.
+func (s *Space) SetLimiter(l *Limiter) {
+	s.admitMtx.Lock()
+	defer s.admitMtx.Unlock()
+
+	s.limiter = l
+	s.series = map[string]int{}
 }
 
 func (s *Space) NodeNames() []string {
@@ -27,27 +51,78 @@ func (s *Space) NodeNames() []string {
 }
 
 // Observe locates the time series identified by the name and label values in
-// the vector space, and appends the value to the list of observations.
-func (s *Space) Observe(name string, lvs LabelValues, value float64) {
-	s.nodeFor(name).observe(lvs, value)
+// the vector space, and folds the value into its aggregator. Label values that
+// cannot be canonicalised are rejected with an error.
+func (s *Space) Observe(name string, lvs LabelValues, value float64) error {
+	return s.update(name, lvs, func(agg Aggregator) { agg.Observe(value) })
 }
 
 // Add locates the time series identified by the name and label values in
-// the vector space, and appends the delta to the last value in the list of
-// observations.
-func (s *Space) Add(name string, lvs LabelValues, delta float64) {
-	s.nodeFor(name).add(lvs, delta)
+// the vector space, and adds the delta to its aggregator's current value.
+// Label values that cannot be canonicalised are rejected with an error.
+func (s *Space) Add(name string, lvs LabelValues, delta float64) error {
+	return s.update(name, lvs, func(agg Aggregator) { agg.Add(delta) })
+}
+
+// update applies fn to the aggregator of the series identified by the name
+// and label values. Series that exist are updated under their node locks
+// only; a new one is admitted and created under the space and admission
+// locks, so that the limiter's count always matches the series in the space.
+func (s *Space) update(name string, lvs LabelValues, fn func(Aggregator)) error {
+	lvs, err := lvs.Canonical()
+	if err != nil {
+		return err
+	}
+
+	newAggregator := s.aggregatorFor(name)
+
+	if s.nodeFor(name).apply(lvs, false, newAggregator, fn) {
+		return nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.admitMtx.Lock()
+	defer s.admitMtx.Unlock()
+
+	n := s.nodeForLocked(name)
+
+	lvs, ok, err := s.admitLocked(name, n, lvs)
+	if !ok {
+		return err
+	}
+
+	n.apply(lvs, true, newAggregator, fn)
+
+	return err
 }
 
 // Walk traverses the vector space and invokes fn for each non-empty time series
-// which is encountered. Return false to abort the traversal.
+// which is encountered, with its aggregator's observations. Series whose
+// aggregator does not implement Observer are skipped. Return false to abort
+// the traversal.
 func (s *Space) Walk(fn func(name string, lvs LabelValues, observations []float64) bool) {
+	s.WalkAggregators(func(name string, lvs LabelValues, agg Aggregator) bool {
+		o, ok := agg.(Observer)
+		if !ok {
+			return true
+		}
+
+		return fn(name, lvs, o.Observations())
+	})
+}
+
+// WalkAggregators traverses the vector space and invokes fn for each non-empty
+// time series which is encountered, with its aggregator and its label values
+// in canonical order. Return false to abort the traversal.
+func (s *Space) WalkAggregators(fn func(name string, lvs LabelValues, agg Aggregator) bool) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
 	for nodeName, node := range s.nodes {
 		nodeNameCopy := nodeName
-		f := func(lvs LabelValues, observations []float64) bool { return fn(nodeNameCopy, lvs, observations) }
+		f := func(lvs LabelValues, agg Aggregator) bool { return fn(nodeNameCopy, lvs, agg) }
 
 		if !node.walk(LabelValues{}, f) {
 			return
@@ -61,16 +136,134 @@ func (s *Space) Reset() *Space {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	n := NewSpace()
+	s.admitMtx.Lock()
+	defer s.admitMtx.Unlock()
+
+	n := NewSpaceWith(s.newAggregator)
 	n.nodes, s.nodes = s.nodes, n.nodes
 
+	if s.limiter != nil {
+		for name, count := range s.series {
+			s.limiter.Release(name, count)
+		}
+
+		s.series = map[string]int{}
+	}
+
 	return n
 }
 
+// Delete removes every time series of the named metric and releases their
+// slots in the limiter. It returns the number of deleted series.
+func (s *Space) Delete(name string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.admitMtx.Lock()
+	defer s.admitMtx.Unlock()
+
+	n, ok := s.nodes[name]
+	if !ok {
+		return 0
+	}
+
+	delete(s.nodes, name)
+
+	if s.limiter != nil {
+		s.limiter.Release(name, s.series[name])
+		delete(s.series, name)
+	}
+
+	return n.prune(LabelValues{}, func(LabelValues, Aggregator) bool { return true })
+}
+
+// Prune deletes the time series for which fn returns true, along with the
+// metrics left without any, and releases their slots in the limiter. fn is
+// called with the series locked, so the series cannot be observed in between.
+// It returns the number of deleted series.
+func (s *Space) Prune(fn func(name string, lvs LabelValues, agg Aggregator) bool) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.admitMtx.Lock()
+	defer s.admitMtx.Unlock()
+
+	pruned := 0
+
+	for name, n := range s.nodes {
+		nameCopy := name
+		admitted := 0
+
+		pruned += n.prune(LabelValues{}, func(lvs LabelValues, agg Aggregator) bool {
+			if !fn(nameCopy, lvs, agg) {
+				return false
+			}
+
+			// the overflow series is not counted by the limiter
+			if !IsOverflow(lvs) {
+				admitted++
+			}
+
+			return true
+		})
+
+		if s.limiter != nil && admitted > 0 {
+			if admitted > s.series[name] {
+				admitted = s.series[name]
+			}
+
+			s.limiter.Release(name, admitted)
+			s.series[name] -= admitted
+		}
+
+		// series are only created in a node under s.mtx, so an empty one can
+		// go even while it is being observed
+		if n.empty() {
+			delete(s.nodes, name)
+
+			if s.limiter != nil && s.series[name] == 0 {
+				delete(s.series, name)
+			}
+		}
+	}
+
+	return pruned
+}
+
+// admitLocked returns the label values under which an observation of the
+// series is recorded, and false if it is dropped. Existing series are always
+// admitted; new ones only if the limiter has room for them, otherwise they are
+// replaced by the overflow series or dropped. The caller holds s.mtx and
+// s.admitMtx.
+func (s *Space) admitLocked(name string, root *node, lvs LabelValues) (LabelValues, bool, error) {
+	if s.limiter == nil || root.has(lvs) {
+		return lvs, true, nil
+	}
+
+	if s.limiter.Admit(name) {
+		s.series[name]++
+		return lvs, true, nil
+	}
+
+	if !s.limiter.Fold() {
+		return nil, false, ErrSeriesDropped
+	}
+
+	return OverflowLabelValues, true, ErrSeriesFolded
+}
+
+func (s *Space) aggregatorFor(name string) func() Aggregator {
+	return func() Aggregator { return s.newAggregator(name) }
+}
+
 func (s *Space) nodeFor(name string) *node {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	return s.nodeForLocked(name)
+}
+
+func (s *Space) nodeForLocked(name string) *node {
 	if s.nodes == nil {
 		s.nodes = map[string]*node{}
 	}
@@ -85,23 +278,35 @@ func (s *Space) nodeFor(name string) *node {
 }
 
 // node exists at a specific point in the N-dimensional vector space of all
-// possible label values. The node collects observations and has child nodes
+// possible label values. The node aggregates observations and has child nodes
 // with greater specificity.
 type node struct {
-	mtx          sync.RWMutex
-	observations []float64
-	children     map[pair]*node
+	mtx      sync.RWMutex
+	agg      Aggregator
+	children map[pair]*node
 }
 
 type pair struct{ label, value string }
 
-func (n *node) observe(lvs LabelValues, value float64) {
+// apply calls fn with the aggregator of the series identified by lvs, with
+// the series locked. Unless create is set, it returns false instead if the
+// series has not been observed.
+func (n *node) apply(lvs LabelValues, create bool, newAggregator func() Aggregator, fn func(Aggregator)) bool {
 	n.mtx.Lock()
 	defer n.mtx.Unlock()
 
 	if len(lvs) == 0 {
-		n.observations = append(n.observations, value)
-		return
+		if n.agg == nil {
+			if !create {
+				return false
+			}
+
+			n.agg = newAggregator()
+		}
+
+		fn(n.agg)
+
+		return true
 	}
 
 	if len(lvs) < minLabelValues {
@@ -110,60 +315,49 @@ func (n *node) observe(lvs LabelValues, value float64) {
 
 	head, tail := pair{lvs[0], lvs[1]}, lvs[2:]
 
-	if n.children == nil {
-		n.children = map[pair]*node{}
-	}
-
 	child, ok := n.children[head]
 	if !ok {
+		if !create {
+			return false
+		}
+
+		if n.children == nil {
+			n.children = map[pair]*node{}
+		}
+
 		child = &node{}
 		n.children[head] = child
 	}
 
-	child.observe(tail, value)
+	return child.apply(tail, create, newAggregator, fn)
 }
 
-func (n *node) add(lvs LabelValues, delta float64) {
-	n.mtx.Lock()
-	defer n.mtx.Unlock()
+// has reports whether the series identified by lvs has been observed.
+func (n *node) has(lvs LabelValues) bool {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
 
 	if len(lvs) == 0 {
-		var value float64
-		if len(n.observations) > 0 {
-			value = last(n.observations) + delta
-		} else {
-			value = delta
-		}
-
-		n.observations = append(n.observations, value)
-
-		return
+		return n.agg != nil
 	}
 
 	if len(lvs) < minLabelValues {
-		panic("too few LabelValues; programmer error!")
-	}
-
-	head, tail := pair{lvs[0], lvs[1]}, lvs[2:]
-
-	if n.children == nil {
-		n.children = map[pair]*node{}
+		return false
 	}
 
-	child, ok := n.children[head]
+	child, ok := n.children[pair{lvs[0], lvs[1]}]
 	if !ok {
-		child = &node{}
-		n.children[head] = child
+		return false
 	}
 
-	child.add(tail, delta)
+	return child.has(lvs[2:])
 }
 
-func (n *node) walk(lvs LabelValues, fn func(LabelValues, []float64) bool) bool {
+func (n *node) walk(lvs LabelValues, fn func(LabelValues, Aggregator) bool) bool {
 	n.mtx.RLock()
 	defer n.mtx.RUnlock()
 
-	if len(n.observations) > 0 && !fn(lvs, n.observations) {
+	if n.agg != nil && !fn(lvs, n.agg) {
 		return false
 	}
 
@@ -176,6 +370,38 @@ func (n *node) walk(lvs LabelValues, fn func(LabelValues, []float64) bool) bool
 	return true
 }
 
+// prune deletes the aggregators below n for which fn returns true, along with
+// the nodes left empty, and returns how many were deleted.
+func (n *node) prune(lvs LabelValues, fn func(LabelValues, Aggregator) bool) int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	pruned := 0
+
+	if n.agg != nil && fn(lvs, n.agg) {
+		n.agg = nil
+		pruned++
+	}
+
+	for p, child := range n.children {
+		pruned += child.prune(append(lvs, p.label, p.value), fn)
+
+		if child.empty() {
+			delete(n.children, p)
+		}
+	}
+
+	return pruned
+}
+
+// empty reports whether n holds no series. The caller holds n's parent lock.
+func (n *node) empty() bool {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+
+	return n.agg == nil && len(n.children) == 0
+}
+
 func last(a []float64) float64 {
 	return a[len(a)-1]
 }
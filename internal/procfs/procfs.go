@@ -0,0 +1,404 @@
+// Package procfs parses the Linux proc and cgroup filesystem files read by
+// the system collectors.
+package procfs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UserHZ is the number of clock ticks per second in which the kernel reports
+// CPU times. It is 100 on every mainstream architecture.
+const UserHZ = 100
+
+var ErrMalformed = errors.New("malformed procfs file")
+
+// ProcStat is the part of /proc/<pid>/stat used by the collectors. CPU and
+// start times are in clock ticks.
+type ProcStat struct {
+	UTime      uint64
+	STime      uint64
+	NumThreads uint64
+	StartTime  uint64
+	VSize      uint64
+}
+
+// ReadProcStat parses a /proc/<pid>/stat file.
+func ReadProcStat(path string) (ProcStat, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ProcStat{}, err
+	}
+
+	// the command name is in parentheses and may contain anything, so the
+	// fields are counted from the last closing one
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return ProcStat{}, fmt.Errorf("%w: %s", ErrMalformed, path)
+	}
+
+	// fields from the state on, the third field of the file
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 21 {
+		return ProcStat{}, fmt.Errorf("%w: %s", ErrMalformed, path)
+	}
+
+	var s ProcStat
+
+	for _, f := range []struct {
+		dst *uint64
+		idx int
+	}{{&s.UTime, 11}, {&s.STime, 12}, {&s.NumThreads, 17}, {&s.StartTime, 19}, {&s.VSize, 20}} {
+		if *f.dst, err = strconv.ParseUint(fields[f.idx], 10, 64); err != nil {
+			return ProcStat{}, fmt.Errorf("%w: %s: %s", ErrMalformed, path, err)
+		}
+	}
+
+	return s, nil
+}
+
+// ReadKeyValues parses files made of "key: value" or "key value" lines, such
+// as /proc/<pid>/status, /proc/<pid>/io and /proc/meminfo. Values keep their
+// unit, if any.
+func ReadKeyValues(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kvs := map[string]string{}
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		line := sc.Text()
+
+		sep := strings.IndexByte(line, ':')
+		if sep < 0 {
+			sep = strings.IndexAny(line, " \t")
+		}
+
+		if sep < 0 {
+			continue
+		}
+
+		kvs[strings.TrimSpace(line[:sep])] = strings.TrimSpace(line[sep+1:])
+	}
+
+	return kvs, sc.Err()
+}
+
+// ParseKB parses a value such as "1024 kB" to bytes. Values without a unit
+// are taken as is.
+func ParseKB(value string) (uint64, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0, ErrMalformed
+	}
+
+	v, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(fields) > 1 && strings.EqualFold(fields[1], "kB") {
+		v *= 1024
+	}
+
+	return v, nil
+}
+
+// ReadBootTime returns the boot time, in seconds since the epoch, from the
+// btime line of /proc/stat.
+func ReadBootTime(path string) (uint64, error) {
+	kvs, err := ReadKeyValues(path)
+	if err != nil {
+		return 0, err
+	}
+
+	btime, ok := kvs["btime"]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s has no btime", ErrMalformed, path)
+	}
+
+	return strconv.ParseUint(btime, 10, 64)
+}
+
+// ReadSoftLimit returns the soft limit of the named resource, such as "Max
+// open files", from /proc/<pid>/limits, and false if it is unlimited.
+func ReadSoftLimit(path, name string) (uint64, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, name) {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, name))
+		if len(fields) == 0 {
+			break
+		}
+
+		if fields[0] == "unlimited" {
+			return 0, false, nil
+		}
+
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+
+		return v, err == nil, err
+	}
+
+	return 0, false, fmt.Errorf("%w: %s has no %q limit", ErrMalformed, path, name)
+}
+
+// CountEntries returns the number of entries in a directory, such as the
+// open file descriptors in /proc/<pid>/fd.
+func CountEntries(path string) (int, error) {
+	d, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+
+	return len(names), err
+}
+
+// CPUModes are the modes of the per-CPU times in /proc/stat, in file order.
+var CPUModes = []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal"}
+
+// ReadCPUTimes returns the times, in clock ticks, of each CPU in /proc/stat
+// by mode, in the order of CPUModes, keyed by CPU number. Modes missing from
+// older kernels are zero.
+func ReadCPUTimes(path string) (map[string][]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cpus := map[string][]uint64{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+
+		times := make([]uint64, len(CPUModes))
+
+		for i := range times {
+			if i+1 >= len(fields) {
+				break
+			}
+
+			if times[i], err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: %s: %s", ErrMalformed, path, err)
+			}
+		}
+
+		cpus[strings.TrimPrefix(fields[0], "cpu")] = times
+	}
+
+	return cpus, nil
+}
+
+// ReadLoadAvg returns the 1, 5 and 15 minute load averages from
+// /proc/loadavg.
+func ReadLoadAvg(path string) ([3]float64, error) {
+	var loads [3]float64
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return loads, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < len(loads) {
+		return loads, fmt.Errorf("%w: %s", ErrMalformed, path)
+	}
+
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return loads, fmt.Errorf("%w: %s: %s", ErrMalformed, path, err)
+		}
+	}
+
+	return loads, nil
+}
+
+// NetDevStats are the counters of a network interface in /proc/net/dev.
+type NetDevStats struct {
+	RxBytes, RxPackets, RxErrors uint64
+	TxBytes, TxPackets, TxErrors uint64
+}
+
+// ReadNetDev returns the counters of every interface in /proc/net/dev,
+// keyed by interface name.
+func ReadNetDev(path string) (map[string]NetDevStats, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	devs := map[string]NetDevStats{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		sep := strings.LastIndexByte(line, ':')
+		if sep < 0 {
+			continue
+		}
+
+		fields := strings.Fields(line[sep+1:])
+		if len(fields) < 16 {
+			continue
+		}
+
+		v := make([]uint64, 16)
+		for i := range v {
+			if v[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: %s: %s", ErrMalformed, path, err)
+			}
+		}
+
+		devs[strings.TrimSpace(line[:sep])] = NetDevStats{
+			RxBytes: v[0], RxPackets: v[1], RxErrors: v[2],
+			TxBytes: v[8], TxPackets: v[9], TxErrors: v[10],
+		}
+	}
+
+	return devs, nil
+}
+
+// DiskStats are the counters of a block device in /proc/diskstats. Sectors
+// are 512 bytes, whatever the device.
+type DiskStats struct {
+	ReadsCompleted  uint64
+	SectorsRead     uint64
+	WritesCompleted uint64
+	SectorsWritten  uint64
+	IOsInProgress   uint64
+	IOTimeMillis    uint64
+}
+
+// ReadDiskStats returns the counters of every device in /proc/diskstats,
+// keyed by device name.
+func ReadDiskStats(path string) (map[string]DiskStats, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	disks := map[string]DiskStats{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 13 {
+			continue
+		}
+
+		v := make([]uint64, 10)
+		for i := range v {
+			if v[i], err = strconv.ParseUint(fields[i+3], 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: %s: %s", ErrMalformed, path, err)
+			}
+		}
+
+		disks[fields[2]] = DiskStats{
+			ReadsCompleted:  v[0],
+			SectorsRead:     v[2],
+			WritesCompleted: v[4],
+			SectorsWritten:  v[6],
+			IOsInProgress:   v[8],
+			IOTimeMillis:    v[9],
+		}
+	}
+
+	return disks, nil
+}
+
+// ErrNoUnifiedCgroup is returned by ReadCgroupPath for processes that are not
+// in a cgroup v2 hierarchy.
+var ErrNoUnifiedCgroup = errors.New("process is not in a cgroup v2 hierarchy")
+
+// ReadCgroupPath returns the cgroup v2 path of a process, from the "0::"
+// line of /proc/<pid>/cgroup.
+func ReadCgroupPath(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+
+	return "", ErrNoUnifiedCgroup
+}
+
+// ReadUint reads a file holding a single number, such as memory.current. ok
+// is false if it holds "max" instead.
+func ReadUint(path string) (v uint64, ok bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, false, nil
+	}
+
+	v, err = strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %s: %s", ErrMalformed, path, err)
+	}
+
+	return v, true, nil
+}
+
+// ReadIOStat parses a cgroup io.stat file into the counters of each device,
+// keyed by "major:minor" and then by counter name, such as rbytes.
+func ReadIOStat(path string) (map[string]map[string]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	devs := map[string]map[string]uint64{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		counters := map[string]uint64{}
+
+		for _, f := range fields[1:] {
+			sep := strings.IndexByte(f, '=')
+			if sep < 0 {
+				continue
+			}
+
+			if v, err := strconv.ParseUint(f[sep+1:], 10, 64); err == nil {
+				counters[f[:sep]] = v
+			}
+		}
+
+		devs[fields[0]] = counters
+	}
+
+	return devs, nil
+}
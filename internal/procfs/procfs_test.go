@@ -0,0 +1,274 @@
+package procfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const fixtures = "testdata/proc"
+
+// writeFile writes content to a file in a temporary directory and returns its
+// path.
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestReadProcStat(t *testing.T) {
+	got, err := ReadProcStat(filepath.Join(fixtures, "self", "stat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ProcStat{UTime: 250, STime: 75, NumThreads: 8, StartTime: 5000, VSize: 104857600}
+	if got != want {
+		t.Errorf("ReadProcStat() = %+v, want %+v", got, want)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"no command", "1234 S 1 1234"},
+		{"too few fields", "1234 (cmd) S 1 1234 1234 0 -1 4194560 1500 0 2 0 250 75"},
+		{"not a number", "1234 (cmd) S 1 1234 1234 0 -1 4194560 1500 0 2 0 x 75 0 0 20 0 8 0 5000 104857600 2560"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadProcStat(writeFile(t, tc.content)); !errors.Is(err, ErrMalformed) {
+				t.Errorf("ReadProcStat() error = %v, want %v", err, ErrMalformed)
+			}
+		})
+	}
+}
+
+func TestReadKeyValues(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want map[string]string
+	}{
+		{"self/status", map[string]string{"Name": "my (weird) cmd", "VmRSS": "10240 kB", "Threads": "8"}},
+		{"self/io", map[string]string{"read_bytes": "4096", "write_bytes": "8192"}},
+		{"stat", map[string]string{"btime": "1700000000", "processes": "4321"}},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			kvs, err := ReadKeyValues(filepath.Join(fixtures, tc.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range tc.want {
+				if kvs[k] != v {
+					t.Errorf("%s = %q, want %q", k, kvs[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKB(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    uint64
+		wantErr bool
+	}{
+		{"10240 kB", 10485760, false},
+		{"4096", 4096, false},
+		{"12 KB", 12288, false},
+		{"", 0, true},
+		{"x kB", 0, true},
+	} {
+		got, err := ParseKB(tc.value)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseKB(%q) = %d, %v, want %d, error %t", tc.value, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestReadBootTime(t *testing.T) {
+	got, err := ReadBootTime(filepath.Join(fixtures, "stat"))
+	if err != nil || got != 1700000000 {
+		t.Errorf("ReadBootTime() = %d, %v, want 1700000000", got, err)
+	}
+
+	if _, err := ReadBootTime(writeFile(t, "cpu  1 2 3 4\n")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("ReadBootTime() without btime error = %v, want %v", err, ErrMalformed)
+	}
+}
+
+func TestReadSoftLimit(t *testing.T) {
+	path := filepath.Join(fixtures, "self", "limits")
+
+	for _, tc := range []struct {
+		name        string
+		want        uint64
+		wantLimited bool
+		wantErr     error
+	}{
+		{"Max open files", 1024, true, nil},
+		{"Max processes", 0, false, nil},
+		{"Max locked memory", 0, false, ErrMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, limited, err := ReadSoftLimit(path, tc.name)
+			if got != tc.want || limited != tc.wantLimited || !errors.Is(err, tc.wantErr) {
+				t.Errorf("ReadSoftLimit() = %d, %t, %v, want %d, %t, %v", got, limited, err, tc.want, tc.wantLimited, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCountEntries(t *testing.T) {
+	got, err := CountEntries(filepath.Join(fixtures, "self", "fd"))
+	if err != nil || got != 3 {
+		t.Errorf("CountEntries() = %d, %v, want 3", got, err)
+	}
+
+	if _, err := CountEntries(filepath.Join(fixtures, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CountEntries() of a missing directory error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestReadCPUTimes(t *testing.T) {
+	got, err := ReadCPUTimes(filepath.Join(fixtures, "stat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]uint64{
+		"0": {300, 5, 120, 4500, 20, 0, 3, 0},
+		"1": {200, 5, 80, 4500, 10, 0, 2, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadCPUTimes() = %v, want %v", got, want)
+	}
+
+	// older kernels report fewer modes
+	got, err = ReadCPUTimes(writeFile(t, "cpu  1 2 3 4\ncpu0 1 2 3 4\n"))
+	if err != nil || !reflect.DeepEqual(got, map[string][]uint64{"0": {1, 2, 3, 4, 0, 0, 0, 0}}) {
+		t.Errorf("ReadCPUTimes() = %v, %v", got, err)
+	}
+}
+
+func TestReadLoadAvg(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		path    string
+		want    [3]float64
+		wantErr error
+	}{
+		{"fixture", filepath.Join(fixtures, "loadavg"), [3]float64{0.5, 1.25, 2}, nil},
+		{"too few fields", writeFile(t, "0.50 1.25\n"), [3]float64{}, ErrMalformed},
+		{"not a number", writeFile(t, "0.50 x 2.00 1/2 3\n"), [3]float64{0.5}, ErrMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ReadLoadAvg(tc.path)
+			if got != tc.want || !errors.Is(err, tc.wantErr) {
+				t.Errorf("ReadLoadAvg() = %v, %v, want %v, %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadNetDev(t *testing.T) {
+	got, err := ReadNetDev(filepath.Join(fixtures, "net", "dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]NetDevStats{
+		"lo":   {RxBytes: 5000, RxPackets: 50, TxBytes: 5000, TxPackets: 50},
+		"eth0": {RxBytes: 1000000, RxPackets: 2000, RxErrors: 3, TxBytes: 500000, TxPackets: 1500, TxErrors: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadNetDev() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadDiskStats(t *testing.T) {
+	got, err := ReadDiskStats(filepath.Join(fixtures, "diskstats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]DiskStats{
+		"sda":   {ReadsCompleted: 100, SectorsRead: 2000, WritesCompleted: 200, SectorsWritten: 4000, IOsInProgress: 1, IOTimeMillis: 300},
+		"sda1":  {ReadsCompleted: 90, SectorsRead: 1800, WritesCompleted: 190, SectorsWritten: 3800, IOTimeMillis: 280},
+		"loop0": {ReadsCompleted: 5, SectorsRead: 10, IOTimeMillis: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDiskStats() = %+v, want %+v", got, want)
+	}
+}
+
+const cgroupFixture = "testdata/cgroup/system.slice/app.service"
+
+func TestReadCgroupPath(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		path    string
+		want    string
+		wantErr error
+	}{
+		{"fixture", filepath.Join(fixtures, "self", "cgroup"), "/system.slice/app.service", nil},
+		{
+			"hybrid",
+			writeFile(t, "12:pids:/user.slice\n1:name=systemd:/user.slice\n0::/user.slice/session-1.scope\n"),
+			"/user.slice/session-1.scope",
+			nil,
+		},
+		{"v1 only", writeFile(t, "12:pids:/user.slice\n1:name=systemd:/user.slice\n"), "", ErrNoUnifiedCgroup},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ReadCgroupPath(tc.path)
+			if got != tc.want || !errors.Is(err, tc.wantErr) {
+				t.Errorf("ReadCgroupPath() = %q, %v, want %q, %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadUint(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		path    string
+		want    uint64
+		wantOK  bool
+		wantErr error
+	}{
+		{"number", filepath.Join(cgroupFixture, "memory.current"), 52428800, true, nil},
+		{"max", filepath.Join(cgroupFixture, "memory.max"), 0, false, nil},
+		{"malformed", writeFile(t, "12 kB\n"), 0, false, ErrMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok, err := ReadUint(tc.path)
+			if got != tc.want || ok != tc.wantOK || !errors.Is(err, tc.wantErr) {
+				t.Errorf("ReadUint() = %d, %t, %v, want %d, %t, %v", got, ok, err, tc.want, tc.wantOK, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadIOStat(t *testing.T) {
+	got, err := ReadIOStat(filepath.Join(cgroupFixture, "io.stat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]uint64{
+		"8:0":   {"rbytes": 1048576, "wbytes": 2097152, "rios": 256, "wios": 512, "dbytes": 0, "dios": 0},
+		"253:1": {"rbytes": 4096, "wbytes": 0, "rios": 1, "wios": 0, "dbytes": 0, "dios": 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadIOStat() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+package quantile
+
+import (
+	"math"
+	"sort"
+)
+
+const bufferSize = 500
+
+// Target is a quantile to be tracked together with its allowed rank error.
+type Target struct {
+	Quantile float64
+	Epsilon  float64
+}
+
+type sample struct {
+	value float64
+	width float64
+	delta float64
+}
+
+// Stream computes approximate quantiles over an unbounded stream of values in
+// bounded memory, using the CKMS targeted quantiles algorithm ("Effective
+// Computation of Biased Quantiles over Data Streams", Cormode et al.).
+// Stream is not safe for concurrent use.
+type Stream struct {
+	targets []Target
+	n       float64
+	samples []sample
+	buf     []float64
+	sorted  bool
+}
+
+// NewTargeted returns a Stream that answers the given quantiles within their
+// rank errors.
+func NewTargeted(targets []Target) *Stream {
+	return &Stream{
+		targets: targets,
+		buf:     make([]float64, 0, bufferSize),
+	}
+}
+
+// Insert adds a value to the stream.
+func (s *Stream) Insert(v float64) {
+	s.buf = append(s.buf, v)
+	s.sorted = false
+
+	if len(s.buf) == cap(s.buf) {
+		s.flush()
+	}
+}
+
+// Query returns the estimated value at quantile q.
+func (s *Stream) Query(q float64) float64 {
+	if len(s.samples) == 0 {
+		// nothing merged yet, the buffer holds every value seen
+		if len(s.buf) == 0 {
+			return 0
+		}
+
+		s.sortBuf()
+
+		i := int(math.Ceil(float64(len(s.buf)) * q))
+		if i > 0 {
+			i--
+		}
+
+		return s.buf[i]
+	}
+
+	s.flush()
+
+	t := math.Ceil(q * s.n)
+	t += math.Ceil(s.invariant(t) / 2)
+
+	prev := s.samples[0]
+
+	var r float64
+
+	for _, c := range s.samples[1:] {
+		r += prev.width
+		if r+c.width+c.delta > t {
+			return prev.value
+		}
+
+		prev = c
+	}
+
+	return prev.value
+}
+
+// Reset discards every value in the stream.
+func (s *Stream) Reset() {
+	s.n = 0
+	s.samples = s.samples[:0]
+	s.buf = s.buf[:0]
+}
+
+func (s *Stream) invariant(r float64) float64 {
+	m := math.MaxFloat64
+
+	for _, t := range s.targets {
+		var f float64
+		if t.Quantile*s.n <= r {
+			f = (2 * t.Epsilon * r) / t.Quantile
+		} else {
+			f = (2 * t.Epsilon * (s.n - r)) / (1 - t.Quantile)
+		}
+
+		if f < m {
+			m = f
+		}
+	}
+
+	return m
+}
+
+func (s *Stream) sortBuf() {
+	if !s.sorted {
+		sort.Float64s(s.buf)
+		s.sorted = true
+	}
+}
+
+func (s *Stream) flush() {
+	s.sortBuf()
+	s.merge(s.buf)
+	s.buf = s.buf[:0]
+}
+
+// merge inserts the sorted values into the sample list and compresses it.
+func (s *Stream) merge(values []float64) {
+	var r float64
+
+	i := 0
+
+	for _, v := range values {
+		inserted := false
+
+		for ; i < len(s.samples); i++ {
+			c := s.samples[i]
+			if c.value > v {
+				s.samples = append(s.samples, sample{})
+				copy(s.samples[i+1:], s.samples[i:])
+				s.samples[i] = sample{value: v, width: 1, delta: math.Max(0, math.Floor(s.invariant(r))-1)}
+				i++
+				inserted = true
+
+				break
+			}
+
+			r += c.width
+		}
+
+		if !inserted {
+			s.samples = append(s.samples, sample{value: v, width: 1})
+			i++
+		}
+
+		s.n++
+		r++
+	}
+
+	s.compress()
+}
+
+func (s *Stream) compress() {
+	if len(s.samples) < 2 {
+		return
+	}
+
+	xi := len(s.samples) - 1
+	x := s.samples[xi]
+	r := s.n - 1 - x.width
+
+	for i := len(s.samples) - 2; i >= 0; i-- {
+		c := s.samples[i]
+
+		if c.width+x.width+x.delta <= s.invariant(r) {
+			x.width += c.width
+			s.samples[xi] = x
+			copy(s.samples[i:], s.samples[i+1:])
+			s.samples = s.samples[:len(s.samples)-1]
+			xi--
+		} else {
+			x = c
+			xi = i
+		}
+
+		r -= c.width
+	}
+}
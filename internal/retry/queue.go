@@ -0,0 +1,286 @@
+package retry
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/series"
+)
+
+// ErrHeld is returned by the push function given to Retry for a batch it held
+// back without trying to push it, which does not count as an attempt.
+var ErrHeld = errors.New("batch held back")
+
+// DropPolicy decides which batch is discarded when a full Queue receives a new
+// one.
+type DropPolicy int
+
+const (
+	// DropOldest discards the batch that has been queued the longest.
+	DropOldest DropPolicy = iota
+	// DropNewest discards the batch being queued.
+	DropNewest
+)
+
+// Backoff computes exponentially growing retry delays. Jitter is the fraction
+// of the delay, in [0, 1], by which each delay is randomly spread.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64
+}
+
+// Delay returns the time to wait before the given retry attempt, starting at 1.
+func (b Backoff) Delay(attempt int, rnd *rand.Rand) time.Duration {
+	d := float64(b.Initial) * math.Pow(b.Factor, float64(attempt-1))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		d *= 1 + b.Jitter*(2*rnd.Float64()-1)
+	}
+
+	return time.Duration(d)
+}
+
+type entry struct {
+	batch    series.Batch
+	attempts int
+	next     time.Time
+	seq      uint64
+}
+
+// Queue is a bounded FIFO of batches waiting to be pushed again.
+type Queue struct {
+	mtx sync.Mutex
+
+	entries     []*entry
+	capacity    int
+	maxAttempts int
+	backoff     Backoff
+	policy      DropPolicy
+	dropped     uint64
+	seq         uint64
+	rnd         *rand.Rand
+}
+
+// NewQueue returns a Queue holding at most capacity batches, each of which is
+// tried at most maxAttempts times.
+func NewQueue(capacity, maxAttempts int, backoff Backoff, policy DropPolicy) *Queue {
+	return &Queue{
+		entries:     make([]*entry, 0, capacity),
+		capacity:    capacity,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		policy:      policy,
+		rnd:         rand.New(rand.NewSource(time.Now().UnixNano())), // nolint:gosec
+	}
+}
+
+// Push queues a batch that was pushed attempts times already, zero for one
+// that was never tried, which is then due right away. A batch that used up its
+// attempts is returned without being queued. If the queue is full, a batch is
+// discarded according to the drop policy and returned.
+func (q *Queue) Push(batch series.Batch, attempts int, now time.Time) (evicted *series.Batch) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if attempts >= q.maxAttempts {
+		q.dropped++
+		return &batch
+	}
+
+	if len(q.entries) >= q.capacity {
+		q.dropped++
+
+		if q.policy == DropNewest {
+			return &batch
+		}
+
+		evicted = &q.entries[0].batch
+		q.entries = q.entries[1:]
+	}
+
+	next := now
+	if attempts > 0 {
+		next = now.Add(q.backoff.Delay(attempts, q.rnd))
+	}
+
+	q.seq++
+	q.entries = append(q.entries, &entry{
+		batch:    batch,
+		attempts: attempts,
+		next:     next,
+		seq:      q.seq,
+	})
+
+	return evicted
+}
+
+// Retry pushes the batches whose backoff has elapsed, oldest first. push
+// returns, along with its error, the batch narrowed down to the targets that
+// failed or that it held back. A failed push counts as an attempt and a held
+// back batch waits for another backoff. Batches that used up their attempts
+// are removed and returned, together with the error of the last failed push.
+// push runs without the queue locked, and batches queued meanwhile may evict
+// the ones it failed, which are returned as well.
+func (q *Queue) Retry(now time.Time, push func(series.Batch) (series.Batch, error)) (exhausted []series.Batch, err error) {
+	due := q.takeDue(now)
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	// a held back batch waits as long as a failed one would
+	requeued, steps := due[:0], make([]int, 0, len(due))
+
+	for _, e := range due {
+		failed, pushErr := push(e.batch)
+		if pushErr == nil {
+			continue
+		}
+
+		e.batch = failed
+		requeued, steps = append(requeued, e), append(steps, e.attempts+1)
+
+		if !errors.Is(pushErr, ErrHeld) {
+			err = pushErr
+			e.attempts++
+		}
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	kept := requeued[:0]
+
+	for i, e := range requeued {
+		if e.attempts >= q.maxAttempts {
+			q.dropped++
+			exhausted = append(exhausted, e.batch)
+
+			continue
+		}
+
+		e.next = now.Add(q.backoff.Delay(steps[i], q.rnd))
+		kept = append(kept, e)
+	}
+
+	return append(exhausted, q.requeue(kept)...), err
+}
+
+// takeDue removes and returns the batches whose backoff has elapsed.
+func (q *Queue) takeDue(now time.Time) []*entry {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	var due []*entry
+
+	remaining := q.entries[:0]
+
+	for _, e := range q.entries {
+		if now.Before(e.next) {
+			remaining = append(remaining, e)
+		} else {
+			due = append(due, e)
+		}
+	}
+
+	for i := len(remaining); i < len(q.entries); i++ {
+		q.entries[i] = nil
+	}
+
+	q.entries = remaining
+
+	return due
+}
+
+// requeue puts entries taken out by takeDue back in their place among the
+// queued ones. Batches queued meanwhile may leave no room for all of them, in
+// which case the batches over capacity are discarded according to the drop
+// policy and returned.
+func (q *Queue) requeue(entries []*entry) (evicted []series.Batch) {
+	merged := make([]*entry, 0, len(q.entries)+len(entries))
+
+	for i, j := 0, 0; i < len(q.entries) || j < len(entries); {
+		if j == len(entries) || (i < len(q.entries) && q.entries[i].seq < entries[j].seq) {
+			merged = append(merged, q.entries[i])
+			i++
+		} else {
+			merged = append(merged, entries[j])
+			j++
+		}
+	}
+
+	for over := len(merged) - q.capacity; over > 0; over-- {
+		q.dropped++
+
+		if q.policy == DropNewest {
+			evicted = append(evicted, merged[len(merged)-1].batch)
+			merged = merged[:len(merged)-1]
+		} else {
+			evicted = append(evicted, merged[0].batch)
+			merged = merged[1:]
+		}
+	}
+
+	q.entries = merged
+
+	return evicted
+}
+
+// Drain removes and returns every queued batch, oldest first.
+func (q *Queue) Drain() []series.Batch {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	batches := make([]series.Batch, 0, len(q.entries))
+	for _, e := range q.entries {
+		batches = append(batches, e.batch)
+	}
+
+	q.entries = q.entries[:0]
+
+	return batches
+}
+
+// NextDue returns when the earliest queued batch may be retried, and false if
+// the queue is empty.
+func (q *Queue) NextDue() (time.Time, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.entries) == 0 {
+		return time.Time{}, false
+	}
+
+	next := q.entries[0].next
+	for _, e := range q.entries[1:] {
+		if e.next.Before(next) {
+			next = e.next
+		}
+	}
+
+	return next, true
+}
+
+// Len returns the number of queued batches.
+func (q *Queue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return len(q.entries)
+}
+
+// Dropped returns the number of batches discarded because the queue was full
+// or because they ran out of attempts.
+func (q *Queue) Dropped() uint64 {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return q.dropped
+}
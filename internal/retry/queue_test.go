@@ -0,0 +1,205 @@
+package retry
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/series"
+)
+
+var errPush = errors.New("push failed")
+
+// batch returns a batch that targets the given sink, which tells batches apart.
+func batch(target string) series.Batch {
+	return series.Batch{Targets: []string{target}}
+}
+
+func targets(batches []series.Batch) []string {
+	var names []string
+	for _, b := range batches {
+		names = append(names, b.Targets[0])
+	}
+
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Factor: 2}
+
+	for _, tc := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	} {
+		if got := b.Delay(tc.attempt, nil); got != tc.want {
+			t.Errorf("Delay(%d) = %v, want %v", tc.attempt, got, tc.want)
+		}
+	}
+
+	b.Jitter = 0.5
+	rnd := rand.New(rand.NewSource(1)) // nolint:gosec
+
+	for i := 0; i < 100; i++ {
+		if got := b.Delay(2, rnd); got < time.Second || got > 3*time.Second {
+			t.Fatalf("Delay(2) with jitter = %v, want within [1s, 3s]", got)
+		}
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name        string
+		policy      DropPolicy
+		wantEvicted string
+		wantQueued  []string
+	}{
+		{"oldest", DropOldest, "a", []string{"b", "c"}},
+		{"newest", DropNewest, "c", []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQueue(2, 3, Backoff{Initial: time.Second, Factor: 2}, tc.policy)
+
+			for _, target := range []string{"a", "b"} {
+				if evicted := q.Push(batch(target), 0, now); evicted != nil {
+					t.Fatalf("Push(%s) evicted %v from a queue with room", target, evicted.Targets)
+				}
+			}
+
+			evicted := q.Push(batch("c"), 0, now)
+			if evicted == nil || evicted.Targets[0] != tc.wantEvicted {
+				t.Fatalf("Push(c) evicted %v, want %s", evicted, tc.wantEvicted)
+			}
+
+			if got := targets(q.Drain()); !equalStrings(got, tc.wantQueued) {
+				t.Errorf("queued %q, want %q", got, tc.wantQueued)
+			}
+
+			if q.Dropped() != 1 {
+				t.Errorf("Dropped() = %d, want 1", q.Dropped())
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	now := time.Now()
+	q := NewQueue(4, 3, Backoff{Initial: time.Second, Factor: 2}, DropOldest)
+	q.Push(batch("a"), 1, now)
+
+	pushes := 0
+	failing := func(b series.Batch) (series.Batch, error) {
+		pushes++
+		return b, errPush
+	}
+
+	// a batch pushed once already waits for its first backoff
+	if _, err := q.Retry(now, failing); err != nil || pushes != 0 {
+		t.Fatalf("Retry() before the backoff pushed %d times, error %v", pushes, err)
+	}
+
+	if next, _ := q.NextDue(); !next.Equal(now.Add(time.Second)) {
+		t.Fatalf("NextDue() = %v, want in 1s", next.Sub(now))
+	}
+
+	now = now.Add(time.Second)
+	if _, err := q.Retry(now, failing); !errors.Is(err, errPush) || pushes != 1 {
+		t.Fatalf("Retry() pushed %d times, error %v", pushes, err)
+	}
+
+	// the second attempt failed, so the third waits twice as long
+	if next, _ := q.NextDue(); !next.Equal(now.Add(2 * time.Second)) {
+		t.Fatalf("NextDue() = %v, want in 2s", next.Sub(now))
+	}
+
+	now = now.Add(2 * time.Second)
+
+	exhausted, err := q.Retry(now, failing)
+	if !errors.Is(err, errPush) || !equalStrings(targets(exhausted), []string{"a"}) {
+		t.Fatalf("Retry() = %v, %v, want a exhausted", targets(exhausted), err)
+	}
+
+	if q.Len() != 0 || q.Dropped() != 1 {
+		t.Errorf("Len() = %d, Dropped() = %d, want 0 and 1", q.Len(), q.Dropped())
+	}
+}
+
+func TestRetryHoldsWhileDisconnected(t *testing.T) {
+	now := time.Now()
+	q := NewQueue(4, 2, Backoff{Initial: time.Second, Factor: 2}, DropOldest)
+	q.Push(batch("a"), 0, now)
+
+	held := func(b series.Batch) (series.Batch, error) { return b, ErrHeld }
+
+	// held back batches use up no attempts, however often they are held
+	for i := 0; i < 5; i++ {
+		exhausted, err := q.Retry(now, held)
+		if err != nil || len(exhausted) != 0 {
+			t.Fatalf("Retry() of a held back batch = %v, %v", targets(exhausted), err)
+		}
+
+		if next, _ := q.NextDue(); !next.Equal(now.Add(time.Second)) {
+			t.Fatalf("NextDue() = %v, want in 1s", next.Sub(now))
+		}
+
+		now = now.Add(time.Second)
+	}
+
+	var pushed []string
+
+	exhausted, err := q.Retry(now, func(b series.Batch) (series.Batch, error) {
+		pushed = append(pushed, b.Targets[0])
+		return series.Batch{}, nil
+	})
+	if err != nil || len(exhausted) != 0 || !equalStrings(pushed, []string{"a"}) || q.Len() != 0 {
+		t.Errorf("Retry() once reconnected pushed %q, = %v, %v, %d left", pushed, targets(exhausted), err, q.Len())
+	}
+}
+
+func TestRetryPushesUnlocked(t *testing.T) {
+	now := time.Now()
+	q := NewQueue(2, 3, Backoff{Initial: time.Second, Factor: 2}, DropOldest)
+	q.Push(batch("a"), 0, now)
+	q.Push(batch("b"), 0, now)
+
+	// batches queued by another export while a retry is pushing take the room
+	// of the ones that failed
+	exhausted, err := q.Retry(now, func(b series.Batch) (series.Batch, error) {
+		q.Push(batch("new-"+b.Targets[0]), 0, now)
+		return b, errPush
+	})
+	if !errors.Is(err, errPush) {
+		t.Fatalf("Retry() error = %v, want %v", err, errPush)
+	}
+
+	if got, want := targets(exhausted), []string{"a", "b"}; !equalStrings(got, want) {
+		t.Errorf("Retry() evicted %q, want %q", got, want)
+	}
+
+	if got, want := targets(q.Drain()), []string{"new-a", "new-b"}; !equalStrings(got, want) {
+		t.Errorf("queued %q, want %q", got, want)
+	}
+}
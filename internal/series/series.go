@@ -0,0 +1,67 @@
+package series
+
+import (
+	"context"
+	"time"
+
+	"github.com/nm-morais/demmon-common/body_types"
+)
+
+// Kind is the type of metric a series was produced by.
+type Kind int
+
+const (
+	KindUntyped Kind = iota
+	KindCounter
+	KindGauge
+	KindHistogram
+	KindSummary
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindCounter:
+		return "counter"
+	case KindGauge:
+		return "gauge"
+	case KindHistogram:
+		return "histogram"
+	case KindSummary:
+		return "summary"
+	case KindUntyped:
+	}
+
+	return "untyped"
+}
+
+// Series is an exported time series along with the kind of metric that
+// produced it, which sinks other than demmon need to encode it. Start is the
+// start of the window the observations of a counter, histogram or summary
+// were made over, which ends at their timestamp; it is zero for gauges.
+type Series struct {
+	Kind  Kind      `json:"kind,omitempty"`
+	Start time.Time `json:"start"`
+	body_types.TimeseriesDTO
+}
+
+// Sink is a destination for batches of exported series.
+type Sink interface {
+	Push(ctx context.Context, batch []Series) error
+}
+
+// DTOs returns the demmon representation of the series in batch.
+func DTOs(batch []Series) []body_types.TimeseriesDTO {
+	dtos := make([]body_types.TimeseriesDTO, 0, len(batch))
+	for _, s := range batch {
+		dtos = append(dtos, s.TimeseriesDTO)
+	}
+
+	return dtos
+}
+
+// Batch is a batch of series along with the names of the sinks it still has
+// to be pushed to. No targets means every sink.
+type Batch struct {
+	Series  []Series `json:"series"`
+	Targets []string `json:"targets,omitempty"`
+}
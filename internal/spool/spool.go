@@ -0,0 +1,487 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix      = ".seg"
+	headerSize         = 8
+	maxRecordBytes     = 64 << 20
+	maxSegmentBytes    = 4 << 20
+	minSegmentsPerCap  = 4
+	segmentPermissions = 0644
+)
+
+// ErrRecordTooLarge is returned by Append for records larger than 64MiB.
+var ErrRecordTooLarge = errors.New("spool record too large")
+
+var errCorruptRecord = errors.New("corrupt spool record")
+
+// Spool is a durable FIFO of opaque records. Records are appended to segment
+// files inside a directory, so whatever is not consumed by Replay survives a
+// process restart. The total size and the age of the spooled data are capped:
+// when either cap is exceeded, the oldest segments are discarded.
+type Spool struct {
+	mtx sync.Mutex
+
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	segBytes int64
+
+	active     *os.File
+	activeSize int64
+	nextSeq    uint64
+	dropped    uint64
+}
+
+// Open opens (or creates) the spool stored in dir. maxBytes caps the size of
+// all segments together, and maxAge, when non-zero, is the age after which a
+// segment is discarded without being replayed.
+func Open(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid spool size cap %d", maxBytes)
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	segBytes := maxBytes / minSegmentsPerCap
+	if segBytes > maxSegmentBytes {
+		segBytes = maxSegmentBytes
+	}
+
+	s := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		segBytes: segBytes,
+	}
+
+	segs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seg := range segs {
+		if err := repairSegment(seg); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(segs) > 0 {
+		s.nextSeq = segs[len(segs)-1].seq + 1
+	}
+
+	return s, s.enforceLimits()
+}
+
+// Append durably appends a record to the end of the spool.
+func (s *Spool) Append(record []byte) error {
+	if len(record) > maxRecordBytes {
+		return fmt.Errorf("%w: %d bytes", ErrRecordTooLarge, len(record))
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.active == nil || s.activeSize >= s.segBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, headerSize+len(record))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+	copy(buf[headerSize:], record)
+
+	if _, err := s.active.Write(buf); err != nil {
+		return s.discardPartial(err)
+	}
+
+	if err := s.active.Sync(); err != nil {
+		return s.discardPartial(err)
+	}
+
+	s.activeSize += int64(len(buf))
+
+	return s.enforceLimits()
+}
+
+// Replay hands every spooled record to fn, oldest first. fn returns the
+// record to keep in its place, nil for a record that is done with, along with
+// an error that stops the replay. The record fn fails on and the ones after it
+// are kept for the next Replay and fn's error is returned. Segments whose
+// records are all kept unchanged are left untouched.
+func (s *Spool) Replay(fn func(record []byte) (keep []byte, err error)) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := s.closeActive(); err != nil {
+		return err
+	}
+
+	if err := s.enforceLimits(); err != nil {
+		return err
+	}
+
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		records, err := readSegment(seg.path)
+		if err != nil {
+			return err
+		}
+
+		kept := make([][]byte, 0, len(records))
+		changed := false
+
+		var fnErr error
+
+		for i, record := range records {
+			var keep []byte
+			if keep, fnErr = fn(record); fnErr != nil {
+				kept = append(kept, records[i:]...)
+				break
+			}
+
+			if keep == nil {
+				changed = true
+				continue
+			}
+
+			if !bytes.Equal(keep, record) {
+				changed = true
+			}
+
+			kept = append(kept, keep)
+		}
+
+		switch {
+		case len(kept) == 0:
+			err = os.Remove(seg.path)
+		case changed:
+			err = rewriteSegment(seg, kept)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+
+	return nil
+}
+
+// Size returns the number of bytes currently held in the spool.
+func (s *Spool) Size() int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	segs, err := s.segments()
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, seg := range segs {
+		size += seg.size
+	}
+
+	return size
+}
+
+// Dropped returns the number of segments discarded because of the size or age
+// caps since the spool was opened.
+func (s *Spool) Dropped() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.dropped
+}
+
+// Close closes the segment currently being written. Spooled records stay on
+// disk and are picked up by the next Open of the same directory.
+func (s *Spool) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.closeActive()
+}
+
+// discardPartial truncates the active segment back to its last complete
+// record after a failed write, so the records appended after it stay
+// readable, and returns err.
+func (s *Spool) discardPartial(err error) error {
+	if truncErr := s.active.Truncate(s.activeSize); truncErr != nil {
+		// the segment can no longer be appended to safely
+		_ = s.closeActive()
+	}
+
+	return err
+}
+
+func (s *Spool) rotate() error {
+	if err := s.closeActive(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%016x%s", s.nextSeq, segmentSuffix))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, segmentPermissions)
+	if err != nil {
+		return err
+	}
+
+	s.nextSeq++
+	s.active = f
+	s.activeSize = 0
+
+	return nil
+}
+
+func (s *Spool) closeActive() error {
+	if s.active == nil {
+		return nil
+	}
+
+	err := s.active.Close()
+	s.active = nil
+	s.activeSize = 0
+
+	return err
+}
+
+// enforceLimits discards the oldest segments until the spool is within its
+// size cap, along with every segment older than the age cap. The segment
+// being written is never discarded.
+func (s *Spool) enforceLimits() error {
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, seg := range segs {
+		total += seg.size
+	}
+
+	for i, seg := range segs {
+		if i == len(segs)-1 && s.active != nil {
+			break
+		}
+
+		expired := s.maxAge > 0 && time.Since(seg.modTime) > s.maxAge
+		if !expired && total <= s.maxBytes {
+			break
+		}
+
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+
+		total -= seg.size
+		s.dropped++
+	}
+
+	return nil
+}
+
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (s *Spool) segments() ([]segment, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]segment, 0, len(infos))
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		segs = append(segs, segment{
+			seq:     seq,
+			path:    filepath.Join(s.dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+
+	return segs, nil
+}
+
+// readSegment returns the records stored in the segment at path. A truncated
+// or corrupt record, which is what a crash in the middle of Append leaves
+// behind, ends the segment.
+func readSegment(path string) ([][]byte, error) {
+	records, _, err := scanSegment(path)
+	return records, err
+}
+
+// repairSegment truncates seg to its last complete record. Append only ever
+// adds to the end of the newest segment, so cutting off a torn record keeps
+// the records appended after the restart readable.
+func repairSegment(seg segment) error {
+	_, valid, err := scanSegment(seg.path)
+	if err != nil {
+		return err
+	}
+
+	if valid == seg.size {
+		return nil
+	}
+
+	if err := os.Truncate(seg.path, valid); err != nil {
+		return err
+	}
+
+	// truncating touches the segment, keep its age for the age cap
+	return os.Chtimes(seg.path, seg.modTime, seg.modTime)
+}
+
+// scanSegment returns the records of the segment at path up to the first
+// truncated or corrupt one, along with the number of bytes they take.
+func scanSegment(path string) (records [][]byte, valid int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r := bufio.NewReader(f)
+	records = [][]byte{}
+
+	for {
+		record, err := readRecord(r, info.Size()-valid)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			return records, valid, nil
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		records = append(records, record)
+		valid += int64(headerSize + len(record))
+	}
+}
+
+// readRecord reads the next record from r, which has remaining bytes left. A
+// length that does not fit in them, which a torn or corrupt header may hold,
+// is reported as a corrupt record before anything is allocated for it.
+func readRecord(r io.Reader, remaining int64) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > remaining-headerSize || length > maxRecordBytes {
+		return nil, errCorruptRecord
+	}
+
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorruptRecord
+	}
+
+	return record, nil
+}
+
+// rewriteSegment atomically replaces seg with one holding only records. The
+// original modification time is kept so the age cap still applies to it.
+func rewriteSegment(seg segment, records [][]byte) error {
+	tmpPath := seg.path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, segmentPermissions)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	header := make([]byte, headerSize)
+
+	for _, record := range records {
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(record)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(record))
+
+		if _, err = w.Write(header); err != nil {
+			break
+		}
+
+		if _, err = w.Write(record); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Chtimes(tmpPath, seg.modTime, seg.modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, seg.path)
+}
@@ -0,0 +1,245 @@
+package spool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openSpool(t *testing.T, dir string, maxBytes int64) *Spool {
+	t.Helper()
+
+	s, err := Open(dir, maxBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s
+}
+
+func appendRecords(t *testing.T, s *Spool, records ...string) {
+	t.Helper()
+
+	for _, r := range records {
+		if err := s.Append([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replayed returns the records of s, oldest first, and keeps them.
+func replayed(t *testing.T, s *Spool) []string {
+	t.Helper()
+
+	var got []string
+
+	err := s.Replay(func(record []byte) ([]byte, error) {
+		got = append(got, string(record))
+		return record, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+func equalRecords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no segments in %s: %v", dir, err)
+	}
+
+	return paths[len(paths)-1]
+}
+
+func TestTornTail(t *testing.T) {
+	header := func(length uint32) []byte {
+		h := make([]byte, headerSize)
+		binary.BigEndian.PutUint32(h[0:4], length)
+
+		return h
+	}
+
+	for _, tc := range []struct {
+		name string
+		tail []byte
+	}{
+		{"partial header", []byte{0, 0, 0}},
+		{"partial record", append(header(10), "abc"...)},
+		{"bad checksum", append(header(3), "abc"...)},
+		{"huge length", append(header(1<<32-1), "abc"...)},
+		{"length past the end", append(header(1<<20), make([]byte, 100)...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s := openSpool(t, dir, 1<<20)
+			appendRecords(t, s, "one", "two")
+
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := os.OpenFile(lastSegment(t, dir), os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := f.Write(tc.tail); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the torn tail is cut off on open, so what is appended after the
+			// restart stays readable
+			s = openSpool(t, dir, 1<<20)
+			appendRecords(t, s, "three")
+
+			if got, want := replayed(t, s), []string{"one", "two", "three"}; !equalRecords(got, want) {
+				t.Errorf("replayed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAppendTooLarge(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 1<<20)
+
+	if err := s.Append(make([]byte, maxRecordBytes+1)); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Append() error = %v, want %v", err, ErrRecordTooLarge)
+	}
+}
+
+func TestSizeCap(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		records     int
+		wantDropped bool
+	}{
+		{"within the cap", 4, false},
+		{"over the cap", 40, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// 400 bytes make segments of 100 bytes, which hold 2 of the 58
+			// byte records below
+			s := openSpool(t, dir, 400)
+
+			for i := 0; i < tc.records; i++ {
+				appendRecords(t, s, fmt.Sprintf("%050d", i))
+			}
+
+			if size := s.Size(); size > 400+2*58 {
+				t.Errorf("Size() = %d, want at most the cap and the segment being written", size)
+			}
+
+			if dropped := s.Dropped() > 0; dropped != tc.wantDropped {
+				t.Errorf("Dropped() = %d, want dropped %t", s.Dropped(), tc.wantDropped)
+			}
+
+			got := replayed(t, s)
+			if len(got) == 0 || got[len(got)-1] != fmt.Sprintf("%050d", tc.records-1) {
+				t.Fatalf("the newest record was not kept: %q", got)
+			}
+
+			// the oldest records are the ones dropped
+			for i := 1; i < len(got); i++ {
+				if got[i-1] >= got[i] {
+					t.Fatalf("records out of order: %q", got)
+				}
+			}
+
+			if !tc.wantDropped && len(got) != tc.records {
+				t.Errorf("replayed %d records, want %d", len(got), tc.records)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	records := []string{"a", "b", "c", "d", "e", "f"}
+
+	for _, tc := range []struct {
+		name string
+		fn   func(record []byte) ([]byte, error)
+		want []string
+	}{
+		{
+			name: "all done",
+			fn:   func([]byte) ([]byte, error) { return nil, nil },
+			want: nil,
+		},
+		{
+			name: "stops at a failure",
+			fn: func(record []byte) ([]byte, error) {
+				if string(record) == "d" {
+					return record, errors.New("sink down")
+				}
+
+				return nil, nil
+			},
+			want: []string{"d", "e", "f"},
+		},
+		{
+			name: "replaces records",
+			fn: func(record []byte) ([]byte, error) {
+				if string(record) == "b" || string(record) == "e" {
+					return bytes.ToUpper(record), nil
+				}
+
+				return nil, nil
+			},
+			want: []string{"B", "E"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// segments of 16 bytes hold two of the 9 byte records each
+			s := openSpool(t, dir, 64)
+			appendRecords(t, s, records...)
+
+			if got := replayed(t, s); !equalRecords(got, records) {
+				t.Fatalf("replayed %q, want %q", got, records)
+			}
+
+			_ = s.Replay(tc.fn)
+
+			// and again after a restart
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := replayed(t, openSpool(t, dir, 64)); !equalRecords(got, tc.want) {
+				t.Errorf("kept %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
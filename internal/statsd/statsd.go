@@ -0,0 +1,136 @@
+// Package statsd encodes observations as StatsD lines, with DogStatsD tags,
+// and packs them into datagrams.
+package statsd
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Line types.
+const (
+	Counter   = "c"
+	Gauge     = "g"
+	Histogram = "h"
+	Timing    = "ms"
+)
+
+var ErrInvalidValue = errors.New("statsd cannot encode NaN or infinite values")
+
+var (
+	nameEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+	tagEscaper  = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
+
+// AppendLine appends a StatsD line, without a trailing newline, to buf. tags
+// holds label and value pairs; constTags is appended as is, already encoded
+// by EncodeTags. A relative gauge line is written when signed is set.
+func AppendLine(buf []byte, name string, value float64, typ string, signed bool, tags []string, constTags string) ([]byte, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return buf, ErrInvalidValue
+	}
+
+	buf = append(buf, nameEscaper.Replace(name)...)
+	buf = append(buf, ':')
+
+	if signed && value >= 0 {
+		buf = append(buf, '+')
+	}
+
+	buf = strconv.AppendFloat(buf, value, 'f', -1, 64)
+	buf = append(buf, '|')
+	buf = append(buf, typ...)
+
+	if len(tags) < 2 && constTags == "" {
+		return buf, nil
+	}
+
+	buf = append(buf, "|#"...)
+	buf = appendTags(buf, tags)
+
+	if constTags != "" {
+		if len(tags) >= 2 {
+			buf = append(buf, ',')
+		}
+
+		buf = append(buf, constTags...)
+	}
+
+	return buf, nil
+}
+
+// EncodeTags encodes label and value pairs as a DogStatsD tag list.
+func EncodeTags(tags []string) string {
+	return string(appendTags(nil, tags))
+}
+
+func appendTags(buf []byte, tags []string) []byte {
+	for i := 0; i+1 < len(tags); i += 2 {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		buf = append(buf, tagEscaper.Replace(strings.ReplaceAll(tags[i], ":", "_"))...)
+		buf = append(buf, ':')
+		buf = append(buf, tagEscaper.Replace(tags[i+1])...)
+	}
+
+	return buf
+}
+
+// Packer packs lines, separated by newlines, into datagrams of at most mtu
+// bytes, which it writes to w. A line longer than mtu goes out on its own.
+type Packer struct {
+	mtx sync.Mutex
+	w   io.Writer
+	mtu int
+	buf []byte
+}
+
+func NewPacker(w io.Writer, mtu int) *Packer {
+	return &Packer{w: w, mtu: mtu, buf: make([]byte, 0, mtu)}
+}
+
+// Write adds a line to the current datagram, first sending it if the line
+// does not fit.
+func (p *Packer) Write(line []byte) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if len(p.buf) > 0 && len(p.buf)+1+len(line) > p.mtu {
+		if err := p.flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(p.buf) > 0 {
+		p.buf = append(p.buf, '\n')
+	}
+
+	p.buf = append(p.buf, line...)
+
+	return nil
+}
+
+// Flush sends the current datagram, if any.
+func (p *Packer) Flush() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.flush()
+}
+
+func (p *Packer) flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	_, err := p.w.Write(p.buf)
+	p.buf = p.buf[:0]
+
+	return err
+}
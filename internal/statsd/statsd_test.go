@@ -0,0 +1,118 @@
+package statsd
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestAppendLine(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		metric    string
+		value     float64
+		typ       string
+		signed    bool
+		tags      []string
+		constTags string
+		want      string
+		wantErr   error
+	}{
+		{name: "counter", metric: "requests", value: 3, typ: Counter, want: "requests:3|c"},
+		{name: "fraction", metric: "load", value: 0.25, typ: Gauge, want: "load:0.25|g"},
+		{name: "name", metric: "a:b|c@d\ne", value: 1, typ: Counter, want: "a_b_c_d_e:1|c"},
+		{name: "signed positive", metric: "queue", value: 2, typ: Gauge, signed: true, want: "queue:+2|g"},
+		{name: "signed negative", metric: "queue", value: -2, typ: Gauge, signed: true, want: "queue:-2|g"},
+		{name: "unsigned gauge", metric: "queue", value: 2, typ: Gauge, want: "queue:2|g"},
+		{name: "tags", metric: "rtt", value: 5, typ: Timing, tags: []string{"path", "/a", "code", "200"}, want: "rtt:5|ms|#path:/a,code:200"},
+		{name: "tag escaping", metric: "m", value: 1, typ: Histogram, tags: []string{"a:b,c", "d|e#f,g\nh"}, want: "m:1|h|#a_b_c:d_e_f_g_h"},
+		{name: "tag value keeps colons", metric: "m", value: 1, typ: Counter, tags: []string{"addr", "host:80"}, want: "m:1|c|#addr:host:80"},
+		{name: "odd tags", metric: "m", value: 1, typ: Counter, tags: []string{"dangling"}, want: "m:1|c"},
+		{name: "constant tags", metric: "m", value: 1, typ: Counter, constTags: "host:h1", want: "m:1|c|#host:h1"},
+		{
+			name:      "tags and constant tags",
+			metric:    "m",
+			value:     1,
+			typ:       Counter,
+			tags:      []string{"k", "v"},
+			constTags: "host:h1,service:svc",
+			want:      "m:1|c|#k:v,host:h1,service:svc",
+		},
+		{name: "NaN", metric: "m", value: math.NaN(), typ: Gauge, wantErr: ErrInvalidValue},
+		{name: "infinity", metric: "m", value: math.Inf(1), typ: Gauge, wantErr: ErrInvalidValue},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := AppendLine(nil, tc.metric, tc.value, tc.typ, tc.signed, tc.tags, tc.constTags)
+			if string(got) != tc.want || !errors.Is(err, tc.wantErr) {
+				t.Errorf("AppendLine() = %q, %v, want %q, %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncodeTags(t *testing.T) {
+	for _, tc := range []struct {
+		tags []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"host", "h1"}, "host:h1"},
+		{[]string{"host", "h1", "service", "svc"}, "host:h1,service:svc"},
+		{[]string{"a#b", "c,d"}, "a_b:c_d"},
+	} {
+		if got := EncodeTags(tc.tags); got != tc.want {
+			t.Errorf("EncodeTags(%q) = %q, want %q", tc.tags, got, tc.want)
+		}
+	}
+}
+
+// datagrams records every write as one datagram.
+type datagrams []string
+
+func (d *datagrams) Write(p []byte) (int, error) {
+	*d = append(*d, string(p))
+	return len(p), nil
+}
+
+func TestPacker(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		mtu   int
+		lines []string
+		want  []string
+	}{
+		{"one line", 16, []string{"a:1|c"}, []string{"a:1|c"}},
+		{"packed", 16, []string{"a:1|c", "b:2|c"}, []string{"a:1|c\nb:2|c"}},
+		{"exactly the mtu", 11, []string{"a:1|c", "b:2|c"}, []string{"a:1|c\nb:2|c"}},
+		{"one byte over", 10, []string{"a:1|c", "b:2|c"}, []string{"a:1|c", "b:2|c"}},
+		{"split", 12, []string{"a:1|c", "b:2|c", "c:3|c"}, []string{"a:1|c\nb:2|c", "c:3|c"}},
+		{"line over the mtu", 8, []string{"a:1|c", "long:12345|c", "b:2|c"}, []string{"a:1|c", "long:12345|c", "b:2|c"}},
+		{"nothing", 8, nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got datagrams
+
+			p := NewPacker(&got, tc.mtu)
+
+			for _, line := range tc.lines {
+				if err := p.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := p.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("datagrams = %q, want %q", got, tc.want)
+			}
+
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("datagram %d = %q, want %q", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package exporter
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nm-morais/demmon-exporter/internal/procfs"
+)
+
+const diskSectorBytes = 512
+
+// nodeMemoryFields maps the /proc/meminfo entries reported by NodeCollector
+// to their metric names.
+var nodeMemoryFields = map[string]string{
+	"MemTotal":     "node_memory_total_bytes",
+	"MemFree":      "node_memory_free_bytes",
+	"MemAvailable": "node_memory_available_bytes",
+	"Buffers":      "node_memory_buffers_bytes",
+	"Cached":       "node_memory_cached_bytes",
+	"Shmem":        "node_memory_shared_bytes",
+	"Slab":         "node_memory_slab_bytes",
+	"SwapTotal":    "node_memory_swap_total_bytes",
+	"SwapFree":     "node_memory_swap_free_bytes",
+}
+
+// NodeFilters select the disk devices and network interfaces reported by a
+// NodeCollector. A name is reported if it matches the include expression, or
+// there is none, and does not match the exclude one.
+type NodeFilters struct {
+	DeviceInclude    *regexp.Regexp
+	DeviceExclude    *regexp.Regexp
+	InterfaceInclude *regexp.Regexp
+	InterfaceExclude *regexp.Regexp
+}
+
+// NodeCollector reports statistics of the host from procfs on Linux: CPU
+// time per CPU and mode, memory, load averages, and per-interface network
+// and per-device disk counters.
+type NodeCollector struct {
+	root    string
+	filters NodeFilters
+
+	mtx  sync.Mutex
+	prev *totals
+}
+
+// NewNodeCollector returns a NodeCollector reading the procfs mounted at
+// root, /proc if empty. Conf.NodeMetrics registers one.
+func NewNodeCollector(root string, filters NodeFilters) *NodeCollector {
+	if root == "" {
+		root = defaultProcRoot
+	}
+
+	return &NodeCollector{root: root, filters: filters, prev: newTotals()}
+}
+
+// Describe implements Collector.
+func (c *NodeCollector) Describe() []Desc {
+	descs := []Desc{
+		{Name: "node_cpu_seconds", Kind: KindCounter, Help: "CPU time per CPU and mode.", Samples: 1},
+		{Name: "node_load1", Kind: KindGauge, Help: "1 minute load average.", Samples: 1},
+		{Name: "node_load5", Kind: KindGauge, Help: "5 minute load average.", Samples: 1},
+		{Name: "node_load15", Kind: KindGauge, Help: "15 minute load average.", Samples: 1},
+		{Name: "node_network_receive_bytes", Kind: KindCounter, Help: "Bytes received.", Samples: 1},
+		{Name: "node_network_receive_packets", Kind: KindCounter, Help: "Packets received.", Samples: 1},
+		{Name: "node_network_receive_errors", Kind: KindCounter, Help: "Receive errors.", Samples: 1},
+		{Name: "node_network_transmit_bytes", Kind: KindCounter, Help: "Bytes transmitted.", Samples: 1},
+		{Name: "node_network_transmit_packets", Kind: KindCounter, Help: "Packets transmitted.", Samples: 1},
+		{Name: "node_network_transmit_errors", Kind: KindCounter, Help: "Transmit errors.", Samples: 1},
+		{Name: "node_disk_reads_completed", Kind: KindCounter, Help: "Reads completed.", Samples: 1},
+		{Name: "node_disk_read_bytes", Kind: KindCounter, Help: "Bytes read.", Samples: 1},
+		{Name: "node_disk_writes_completed", Kind: KindCounter, Help: "Writes completed.", Samples: 1},
+		{Name: "node_disk_written_bytes", Kind: KindCounter, Help: "Bytes written.", Samples: 1},
+		{Name: "node_disk_io_time_seconds", Kind: KindCounter, Help: "Time spent doing I/O.", Samples: 1},
+		{Name: "node_disk_io_now", Kind: KindGauge, Help: "I/Os in progress.", Samples: 1},
+	}
+
+	keys := make([]string, 0, len(nodeMemoryFields))
+	for key := range nodeMemoryFields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		descs = append(descs, Desc{Name: nodeMemoryFields[key], Kind: KindGauge, Help: key + " in /proc/meminfo.", Samples: 1})
+	}
+
+	return descs
+}
+
+// Collect implements Collector. A file that cannot be read is skipped, and
+// only fails the collection if none of them can be.
+func (c *NodeCollector) Collect(ctx context.Context, emit EmitFunc) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	sources := []func(EmitFunc) error{c.collectCPU, c.collectMemory, c.collectLoad, c.collectNet, c.collectDisks}
+
+	var (
+		firstErr error
+		failed   int
+	)
+
+	for _, collect := range sources {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := collect(emit); err != nil {
+			failed++
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if failed == len(sources) {
+		return firstErr
+	}
+
+	// the totals of a file that could not be read are kept for the next
+	// collection; otherwise those of CPUs and devices that are gone go
+	if failed == 0 {
+		c.prev.prune()
+	}
+
+	return nil
+}
+
+func (c *NodeCollector) collectCPU(emit EmitFunc) error {
+	cpus, err := procfs.ReadCPUTimes(filepath.Join(c.root, "stat"))
+	if err != nil {
+		return err
+	}
+
+	for cpu, times := range cpus {
+		for i, mode := range procfs.CPUModes {
+			c.counter(emit, "node_cpu_seconds", float64(times[i])/procfs.UserHZ, "cpu", cpu, "mode", mode)
+		}
+	}
+
+	return nil
+}
+
+func (c *NodeCollector) collectMemory(emit EmitFunc) error {
+	meminfo, err := procfs.ReadKeyValues(filepath.Join(c.root, "meminfo"))
+	if err != nil {
+		return err
+	}
+
+	for key, name := range nodeMemoryFields {
+		value, ok := meminfo[key]
+		if !ok {
+			continue
+		}
+
+		if v, err := procfs.ParseKB(value); err == nil {
+			gauge(emit, name, float64(v))
+		}
+	}
+
+	return nil
+}
+
+func (c *NodeCollector) collectLoad(emit EmitFunc) error {
+	loads, err := procfs.ReadLoadAvg(filepath.Join(c.root, "loadavg"))
+	if err != nil {
+		return err
+	}
+
+	gauge(emit, "node_load1", loads[0])
+	gauge(emit, "node_load5", loads[1])
+	gauge(emit, "node_load15", loads[2])
+
+	return nil
+}
+
+func (c *NodeCollector) collectNet(emit EmitFunc) error {
+	devs, err := procfs.ReadNetDev(filepath.Join(c.root, "net", "dev"))
+	if err != nil {
+		return err
+	}
+
+	for dev, s := range devs {
+		if !matches(dev, c.filters.InterfaceInclude, c.filters.InterfaceExclude) {
+			continue
+		}
+
+		c.counter(emit, "node_network_receive_bytes", float64(s.RxBytes), "device", dev)
+		c.counter(emit, "node_network_receive_packets", float64(s.RxPackets), "device", dev)
+		c.counter(emit, "node_network_receive_errors", float64(s.RxErrors), "device", dev)
+		c.counter(emit, "node_network_transmit_bytes", float64(s.TxBytes), "device", dev)
+		c.counter(emit, "node_network_transmit_packets", float64(s.TxPackets), "device", dev)
+		c.counter(emit, "node_network_transmit_errors", float64(s.TxErrors), "device", dev)
+	}
+
+	return nil
+}
+
+func (c *NodeCollector) collectDisks(emit EmitFunc) error {
+	disks, err := procfs.ReadDiskStats(filepath.Join(c.root, "diskstats"))
+	if err != nil {
+		return err
+	}
+
+	for dev, s := range disks {
+		if !matches(dev, c.filters.DeviceInclude, c.filters.DeviceExclude) {
+			continue
+		}
+
+		c.counter(emit, "node_disk_reads_completed", float64(s.ReadsCompleted), "device", dev)
+		c.counter(emit, "node_disk_read_bytes", float64(s.SectorsRead*diskSectorBytes), "device", dev)
+		c.counter(emit, "node_disk_writes_completed", float64(s.WritesCompleted), "device", dev)
+		c.counter(emit, "node_disk_written_bytes", float64(s.SectorsWritten*diskSectorBytes), "device", dev)
+		c.counter(emit, "node_disk_io_time_seconds", float64(s.IOTimeMillis)/1000, "device", dev)
+		emit("node_disk_io_now", map[string]string{"device": dev}, map[string]interface{}{"value": float64(s.IOsInProgress)})
+	}
+
+	return nil
+}
+
+// counter emits the increase of a labelled total since the previous
+// collection. Nothing is emitted the first time the total is read.
+func (c *NodeCollector) counter(emit EmitFunc, name string, total float64, labelValues ...string) {
+	key := name + "\xff" + strings.Join(labelValues, "\xff")
+
+	d, ok := c.prev.increase(key, total)
+	if !ok {
+		return
+	}
+
+	labels := make(map[string]string, len(labelValues)/2)
+	for i := 0; i+1 < len(labelValues); i += 2 {
+		labels[labelValues[i]] = labelValues[i+1]
+	}
+
+	emit(name, labels, map[string]interface{}{"count": d})
+}
+
+func matches(name string, include, exclude *regexp.Regexp) bool {
+	if include != nil && !include.MatchString(name) {
+		return false
+	}
+
+	return exclude == nil || !exclude.MatchString(name)
+}
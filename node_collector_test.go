@@ -0,0 +1,221 @@
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// copyFixtures copies the named files of the procfs fixtures to a temporary
+// root, which is returned.
+func copyFixtures(t *testing.T, names ...string) string {
+	t.Helper()
+
+	root := t.TempDir()
+
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(procFixtures, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+// rewriteFixture replaces old with new in the named file under root.
+func rewriteFixture(t *testing.T, root, name, old, new string) {
+	t.Helper()
+
+	path := filepath.Join(root, name)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(data), old) {
+		t.Fatalf("%s does not contain %q", name, old)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(strings.Replace(string(data), old, new, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeCollector(t *testing.T) {
+	root := copyFixtures(t, "stat", "meminfo", "loadavg", "net/dev", "diskstats")
+	c := NewNodeCollector(root, NodeFilters{
+		DeviceExclude:    regexp.MustCompile(`^loop`),
+		InterfaceInclude: regexp.MustCompile(`^eth`),
+	})
+
+	check := func(t *testing.T, got map[string]map[string]interface{}, want map[string]float64) {
+		t.Helper()
+
+		for key, want := range want {
+			fields, ok := got[key]
+
+			switch {
+			case want < 0 && ok:
+				t.Errorf("%s was collected, want it left out", key)
+			case want < 0:
+			case !ok:
+				t.Errorf("%s was not collected", key)
+			default:
+				for _, v := range fields {
+					if v != want {
+						t.Errorf("%s = %v, want %v", key, v, want)
+					}
+				}
+			}
+		}
+	}
+
+	gauges := map[string]float64{
+		"node_memory_total_bytes":      8000000 * 1024,
+		"node_memory_available_bytes":  4000000 * 1024,
+		"node_load1":                   0.5,
+		"node_load15":                  2,
+		"node_disk_io_now{device=sda}": 1,
+	}
+
+	// the first collection only reads the baselines of the counters
+	first := map[string]float64{
+		"node_cpu_seconds{cpu=0,mode=user}":       -1,
+		"node_network_receive_bytes{device=eth0}": -1,
+		"node_disk_read_bytes{device=sda}":        -1,
+	}
+	for key, v := range gauges {
+		first[key] = v
+	}
+
+	t.Run("first", func(t *testing.T) { check(t, collectedSeries(t, c), first) })
+
+	rewriteFixture(t, root, "net/dev", "eth0: 1000000", "eth0: 1000500")
+	rewriteFixture(t, root, "stat", "cpu0 300", "cpu0 450")
+
+	second := map[string]float64{
+		"node_cpu_seconds{cpu=0,mode=user}":          1.5,
+		"node_cpu_seconds{cpu=1,mode=idle}":          0,
+		"node_network_receive_bytes{device=eth0}":    500,
+		"node_network_transmit_errors{device=eth0}":  0,
+		"node_network_receive_packets{device=eth0}":  0,
+		"node_network_transmit_packets{device=eth0}": 0,
+		"node_disk_read_bytes{device=sda}":           0,
+		"node_disk_io_time_seconds{device=sda1}":     0,
+		"node_disk_writes_completed{device=sda}":     0,
+		"node_disk_written_bytes{device=sda1}":       0,
+		"node_network_receive_bytes{device=lo}":      -1,
+		"node_disk_reads_completed{device=loop0}":    -1,
+	}
+	for key, v := range gauges {
+		second[key] = v
+	}
+
+	t.Run("second", func(t *testing.T) { check(t, collectedSeries(t, c), second) })
+}
+
+func TestNodeCollectorSkipsUnreadableFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   []string
+		want    []string
+		wantErr bool
+	}{
+		{"all", []string{"stat", "meminfo", "loadavg", "net/dev", "diskstats"}, []string{"node_load1", "node_disk_io_now{device=sda}"}, false},
+		{"load only", []string{"loadavg"}, []string{"node_load1"}, false},
+		{"no disks", []string{"stat", "loadavg", "net/dev"}, []string{"node_cpu_seconds{cpu=0,mode=user}", "node_load5"}, false},
+		{"none", nil, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewNodeCollector(copyFixtures(t, tc.files...), NodeFilters{})
+
+			// the first collection only reads the baselines of the counters
+			_ = c.Collect(context.Background(), func(string, map[string]string, map[string]interface{}) {})
+
+			got := map[string]bool{}
+
+			err := c.Collect(context.Background(), func(name string, labels map[string]string, _ map[string]interface{}) {
+				if dev, ok := labels["device"]; ok {
+					name += "{device=" + dev + "}"
+				} else if cpu, ok := labels["cpu"]; ok {
+					name += "{cpu=" + cpu + ",mode=" + labels["mode"] + "}"
+				}
+
+				got[name] = true
+			})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Collect() error = %v, want error %t", err, tc.wantErr)
+			}
+
+			for _, name := range tc.want {
+				if !got[name] {
+					t.Errorf("%s was not collected", name)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeCollectorForgetsRemovedDevices(t *testing.T) {
+	root := copyFixtures(t, "stat", "meminfo", "loadavg", "net/dev", "diskstats")
+	c := NewNodeCollector(root, NodeFilters{})
+
+	collectedSeries(t, c)
+
+	diskstats := filepath.Join(root, "diskstats")
+
+	data, err := ioutil.ReadFile(diskstats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sda1 is removed
+	var kept []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.Contains(line, " sda1 ") {
+			kept = append(kept, line)
+		}
+	}
+
+	if err := ioutil.WriteFile(diskstats, []byte(strings.Join(kept, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got := collectedSeries(t, c)
+	if v := got["node_disk_reads_completed{device=sda}"]["count"]; v != 0.0 {
+		t.Errorf("sda reads increased by %v, want 0", v)
+	}
+
+	for key := range c.prev.values {
+		if strings.Contains(key, "sda1") {
+			t.Errorf("the total %q of a removed device is still held", key)
+		}
+	}
+
+	// the totals of a file that cannot be read are kept until it can be
+	if err := os.Remove(diskstats); err != nil {
+		t.Fatal(err)
+	}
+
+	collectedSeries(t, c)
+
+	if _, ok := c.prev.values["node_disk_reads_completed\xffdevice\xffsda"]; !ok {
+		t.Error("the totals of an unreadable file were dropped")
+	}
+}
@@ -0,0 +1,497 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/generic"
+)
+
+const otlpTemporalityDelta = 1
+
+// OTLPConf configures an OTLPSink.
+type OTLPConf struct {
+	// Endpoint is the full URL metrics are POSTed to, usually ending in
+	// /v1/metrics.
+	Endpoint string
+	Headers  map[string]string
+	Timeout  time.Duration
+	Client   *http.Client
+}
+
+// OTLPSink pushes series to an OpenTelemetry collector over OTLP/HTTP, using
+// the JSON encoding. Counters become delta sums, gauges and untyped series
+// gauges, histograms delta explicit-bucket histograms, and summaries
+// summaries. The exporter's global tags become resource attributes.
+type OTLPSink struct {
+	conf   OTLPConf
+	client *http.Client
+
+	mtx      sync.Mutex
+	resource map[string]string
+}
+
+// NewOTLPSink returns a sink that POSTs to conf.Endpoint.
+func NewOTLPSink(conf OTLPConf) *OTLPSink {
+	c := conf.Client
+	if c == nil {
+		c = &http.Client{Timeout: conf.Timeout}
+	}
+
+	return &OTLPSink{
+		conf:     conf,
+		client:   c,
+		resource: map[string]string{},
+	}
+}
+
+func (s *OTLPSink) setGlobalTags(tags map[string]string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.resource = tags
+}
+
+// Name implements NamedSink.
+func (s *OTLPSink) Name() string {
+	return "otlp:" + s.conf.Endpoint
+}
+
+// Push implements Sink.
+func (s *OTLPSink) Push(ctx context.Context, batch []Series) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(s.encode(batch))
+	if err != nil {
+		return err
+	}
+
+	if s.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.conf.Timeout)
+
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.conf.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", ContentTypeJSON)
+
+	for k, v := range s.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp endpoint %s returned %s", s.conf.Endpoint, resp.Status)
+	}
+
+	return nil
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+	Summary   *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+// 64 bit integers are strings in the JSON encoding of protobuf.
+type otlpPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+}
+
+type otlpNumberDataPoint struct {
+	otlpPoint
+	AsDouble float64 `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	otlpPoint
+	Count          string    `json:"count"`
+	Sum            float64   `json:"sum"`
+	BucketCounts   []string  `json:"bucketCounts"`
+	ExplicitBounds []float64 `json:"explicitBounds"`
+}
+
+type otlpSummaryDataPoint struct {
+	otlpPoint
+	Count          string              `json:"count"`
+	Sum            float64             `json:"sum"`
+	QuantileValues []otlpQuantileValue `json:"quantileValues"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// otlpResourceKeys maps global tags onto OpenTelemetry semantic conventions.
+var otlpResourceKeys = map[string]string{
+	"service": "service.name",
+	"host":    "host.name",
+}
+
+func (s *OTLPSink) encode(batch []Series) otlpRequest {
+	s.mtx.Lock()
+	resource := s.resource
+	s.mtx.Unlock()
+
+	resAttrs := make([]otlpKeyValue, 0, len(resource))
+	for _, k := range sortedKeys(resource) {
+		key := k
+		if mapped, ok := otlpResourceKeys[k]; ok {
+			key = mapped
+		}
+
+		resAttrs = append(resAttrs, otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: resource[k]}})
+	}
+
+	metrics := make([]otlpMetric, 0, len(batch))
+
+	for i := range batch {
+		sr := &batch[i]
+
+		for _, obs := range sr.Values {
+			point := otlpPoint{
+				Attributes:        otlpAttributes(sr.TSTags, resource),
+				StartTimeUnixNano: otlpStartTime(sr, obs.TS),
+				TimeUnixNano:      strconv.FormatInt(obs.TS.UnixNano(), 10),
+			}
+
+			metrics = append(metrics, otlpMetrics(sr, point, obs.Fields)...)
+		}
+	}
+
+	return otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{Attributes: resAttrs},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "demmon-exporter"},
+				Metrics: otlpGroup(metrics),
+			}},
+		}},
+	}
+}
+
+// otlpGroup merges the data points of the metrics of the same name and type
+// into the first of them, so each metric appears once in the request.
+func otlpGroup(metrics []otlpMetric) []otlpMetric {
+	type key struct {
+		name     string
+		dataType int
+	}
+
+	first := make(map[key]int, len(metrics))
+	grouped := metrics[:0]
+
+	for _, m := range metrics {
+		k := key{name: m.Name, dataType: m.dataType()}
+
+		i, ok := first[k]
+		if !ok {
+			first[k] = len(grouped)
+			grouped = append(grouped, m)
+
+			continue
+		}
+
+		g := grouped[i]
+
+		switch {
+		case m.Sum != nil:
+			g.Sum.DataPoints = append(g.Sum.DataPoints, m.Sum.DataPoints...)
+		case m.Gauge != nil:
+			g.Gauge.DataPoints = append(g.Gauge.DataPoints, m.Gauge.DataPoints...)
+		case m.Histogram != nil:
+			g.Histogram.DataPoints = append(g.Histogram.DataPoints, m.Histogram.DataPoints...)
+		case m.Summary != nil:
+			g.Summary.DataPoints = append(g.Summary.DataPoints, m.Summary.DataPoints...)
+		}
+	}
+
+	return grouped
+}
+
+// dataType tells apart the metrics that carry sums, gauges, histograms and
+// summaries.
+func (m *otlpMetric) dataType() int {
+	switch {
+	case m.Sum != nil:
+		return 1
+	case m.Gauge != nil:
+		return 2
+	case m.Histogram != nil:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// otlpStartTime returns the start of the delta window of sr ending at ts, as
+// recorded with the series when it was exported, so that retried and spooled
+// batches keep theirs. Series that do not have one, such as those read from
+// files written by earlier versions, get an empty window ending at ts.
+func otlpStartTime(sr *Series, ts time.Time) string {
+	start := sr.Start
+	if start.IsZero() || start.After(ts) {
+		start = ts
+	}
+
+	return strconv.FormatInt(start.UnixNano(), 10)
+}
+
+func otlpMetrics(sr *Series, point otlpPoint, fields map[string]interface{}) []otlpMetric {
+	switch sr.Kind {
+	case KindCounter:
+		v, _ := toFloat(fields["count"])
+
+		return []otlpMetric{{Name: sr.MeasurementName, Sum: &otlpSum{
+			AggregationTemporality: otlpTemporalityDelta,
+			IsMonotonic:            true,
+			DataPoints:             []otlpNumberDataPoint{{otlpPoint: point, AsDouble: v}},
+		}}}
+	case KindHistogram:
+		return []otlpMetric{{Name: sr.MeasurementName, Histogram: &otlpHistogram{
+			AggregationTemporality: otlpTemporalityDelta,
+			DataPoints:             []otlpHistogramDataPoint{otlpHistogramPoint(point, fields)},
+		}}}
+	case KindSummary:
+		return otlpSummaryMetrics(sr.MeasurementName, point, fields)
+	case KindGauge, KindUntyped:
+	}
+
+	if v, ok := toFloat(fields["value"]); ok && len(fields) == 1 {
+		return []otlpMetric{otlpGaugeMetric(sr.MeasurementName, point, v)}
+	}
+
+	metrics := make([]otlpMetric, 0, len(fields))
+
+	for _, f := range sortedFieldKeys(fields) {
+		if v, ok := toFloat(fields[f]); ok {
+			metrics = append(metrics, otlpGaugeMetric(sr.MeasurementName+"."+f, point, v))
+		}
+	}
+
+	return metrics
+}
+
+func otlpGaugeMetric(name string, point otlpPoint, v float64) otlpMetric {
+	point.StartTimeUnixNano = ""
+
+	return otlpMetric{Name: name, Gauge: &otlpGauge{
+		DataPoints: []otlpNumberDataPoint{{otlpPoint: point, AsDouble: v}},
+	}}
+}
+
+func otlpHistogramPoint(point otlpPoint, fields map[string]interface{}) otlpHistogramDataPoint {
+	type bucket struct {
+		upper float64
+		count float64
+	}
+
+	buckets := []bucket{}
+	cumulative := false
+
+	for f, raw := range fields {
+		upper, cum, ok := generic.ParseBucketField(f)
+		if !ok {
+			continue
+		}
+
+		v, _ := toFloat(raw)
+		buckets = append(buckets, bucket{upper: upper, count: v})
+		cumulative = cum
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upper < buckets[j].upper })
+
+	p := otlpHistogramDataPoint{
+		otlpPoint:      point,
+		BucketCounts:   make([]string, 0, len(buckets)),
+		ExplicitBounds: make([]float64, 0, len(buckets)),
+	}
+
+	var prev float64
+
+	for _, b := range buckets {
+		count := b.count
+		if cumulative {
+			count, prev = b.count-prev, b.count
+		}
+
+		p.BucketCounts = append(p.BucketCounts, strconv.FormatUint(uint64(count), 10))
+
+		if !math.IsInf(b.upper, 1) {
+			p.ExplicitBounds = append(p.ExplicitBounds, b.upper)
+		}
+	}
+
+	count, _ := toFloat(fields[generic.CountField])
+	p.Count = strconv.FormatUint(uint64(count), 10)
+	p.Sum, _ = toFloat(fields[generic.SumField])
+
+	return p
+}
+
+func otlpSummaryMetrics(name string, point otlpPoint, fields map[string]interface{}) []otlpMetric {
+	p := otlpSummaryDataPoint{otlpPoint: point}
+
+	for f, raw := range fields {
+		if q, ok := generic.ParseQuantileField(f); ok {
+			v, _ := toFloat(raw)
+			p.QuantileValues = append(p.QuantileValues, otlpQuantileValue{Quantile: q, Value: v})
+		}
+	}
+
+	sort.Slice(p.QuantileValues, func(i, j int) bool { return p.QuantileValues[i].Quantile < p.QuantileValues[j].Quantile })
+
+	count, _ := toFloat(fields[generic.CountField])
+	p.Count = strconv.FormatUint(uint64(count), 10)
+	p.Sum, _ = toFloat(fields[generic.SumField])
+
+	metrics := []otlpMetric{{Name: name, Summary: &otlpSummary{DataPoints: []otlpSummaryDataPoint{p}}}}
+
+	// OTLP summaries have no minimum and maximum, they go out as gauges
+	for _, f := range []string{generic.MinField, generic.MaxField} {
+		if v, ok := toFloat(fields[f]); ok {
+			metrics = append(metrics, otlpGaugeMetric(name+"."+f, point, v))
+		}
+	}
+
+	return metrics
+}
+
+// otlpAttributes returns the tags that are not resource attributes.
+func otlpAttributes(tags, resource map[string]string) []otlpKeyValue {
+	attrs := make([]otlpKeyValue, 0, len(tags))
+
+	for _, k := range sortedKeys(tags) {
+		if v, ok := resource[k]; ok && v == tags[k] {
+			continue
+		}
+
+		attrs = append(attrs, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: tags[k]}})
+	}
+
+	return attrs
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedFieldKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// toFloat converts a field value, as built by Export or decoded from JSON, to
+// a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
@@ -0,0 +1,222 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nm-morais/demmon-common/body_types"
+)
+
+func TestOTLPSinkExport(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		reqs []otlpRequest
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != ContentTypeJSON {
+			t.Errorf("content type = %q, want %q", ct, ContentTypeJSON)
+		}
+
+		if r.Header.Get("X-Token") != "secret" {
+			t.Errorf("missing configured header")
+		}
+
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+
+		mtx.Lock()
+		reqs = append(reqs, req)
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	sink := NewOTLPSink(OTLPConf{Endpoint: srv.URL + "/v1/metrics", Headers: map[string]string{"X-Token": "secret"}})
+
+	e, err, _ := New(&Conf{
+		Offline:   true,
+		LogFolder: t.TempDir(),
+		LogFile:   "exporter.log",
+		Sinks:     []Sink{sink},
+	}, "h1", "svc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	c := e.NewCounter("requests", 1)
+	h := e.NewHistogram("latency", 1, []float64{1, 5})
+
+	c.Add(3)
+	h.Observe(0.5)
+	h.Observe(3)
+	h.Observe(10)
+
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Add(2)
+
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+
+	resource := map[string]string{}
+	for _, kv := range reqs[0].ResourceMetrics[0].Resource.Attributes {
+		resource[kv.Key] = kv.Value.StringValue
+	}
+
+	if resource["service.name"] != "svc" || resource["host.name"] != "h1" {
+		t.Errorf("resource attributes = %v", resource)
+	}
+
+	first := otlpMetricsByName(reqs[0])
+	second := otlpMetricsByName(reqs[1])
+
+	sum := first["requests"].Sum
+	if sum == nil || sum.AggregationTemporality != otlpTemporalityDelta || !sum.IsMonotonic {
+		t.Fatalf("requests is not a delta monotonic sum: %+v", first["requests"])
+	}
+
+	p := sum.DataPoints[0]
+	if p.AsDouble != 3 {
+		t.Errorf("requests = %v, want 3", p.AsDouble)
+	}
+
+	start, end := otlpNanos(t, p.StartTimeUnixNano), otlpNanos(t, p.TimeUnixNano)
+	if start == 0 || start > end {
+		t.Errorf("start %d is not before time %d", start, end)
+	}
+
+	next := second["requests"].Sum.DataPoints[0]
+	if next.AsDouble != 2 {
+		t.Errorf("second requests = %v, want 2", next.AsDouble)
+	}
+
+	if next.StartTimeUnixNano != p.TimeUnixNano {
+		t.Errorf("second window starts at %s, want the first export at %s", next.StartTimeUnixNano, p.TimeUnixNano)
+	}
+
+	hist := first["latency"].Histogram
+	if hist == nil || hist.AggregationTemporality != otlpTemporalityDelta {
+		t.Fatalf("latency is not a delta histogram: %+v", first["latency"])
+	}
+
+	hp := hist.DataPoints[0]
+	if hp.Count != "3" || hp.Sum != 13.5 {
+		t.Errorf("latency count, sum = %s, %v, want 3, 13.5", hp.Count, hp.Sum)
+	}
+
+	want := []string{"1", "1", "1"}
+	if len(hp.BucketCounts) != len(want) || len(hp.ExplicitBounds) != 2 {
+		t.Fatalf("latency buckets = %v, bounds = %v", hp.BucketCounts, hp.ExplicitBounds)
+	}
+
+	for i := range want {
+		if hp.BucketCounts[i] != want[i] {
+			t.Errorf("latency buckets = %v, want %v", hp.BucketCounts, want)
+			break
+		}
+	}
+
+	if hp.StartTimeUnixNano != p.StartTimeUnixNano {
+		t.Errorf("latency window starts at %s, want %s", hp.StartTimeUnixNano, p.StartTimeUnixNano)
+	}
+}
+
+func otlpMetricsByName(req otlpRequest) map[string]otlpMetric {
+	m := map[string]otlpMetric{}
+
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				m[metric.Name] = metric
+			}
+		}
+	}
+
+	return m
+}
+
+func otlpNanos(t *testing.T, s string) int64 {
+	t.Helper()
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", s, err)
+	}
+
+	return n
+}
+
+func TestOTLPGroupsDataPoints(t *testing.T) {
+	now := time.Now()
+
+	point := func(kind Kind, name, path string, fields map[string]interface{}) Series {
+		tags := map[string]string{"path": path}
+
+		return Series{Kind: kind, TimeseriesDTO: body_types.NewTimeseriesDTO(name, tags, body_types.NewObservableDTO(fields, now))}
+	}
+
+	req := NewOTLPSink(OTLPConf{}).encode([]Series{
+		point(KindCounter, "requests", "/a", map[string]interface{}{"count": 1.0}),
+		point(KindGauge, "inflight", "/a", map[string]interface{}{"value": 2.0}),
+		point(KindCounter, "requests", "/b", map[string]interface{}{"count": 3.0}),
+		point(KindGauge, "requests", "/c", map[string]interface{}{"value": 4.0}),
+		point(KindGauge, "inflight", "/b", map[string]interface{}{"value": 5.0}),
+	})
+
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+
+	type group struct {
+		name   string
+		values []float64
+	}
+
+	var got []group
+
+	for _, m := range metrics {
+		g := group{name: m.Name}
+
+		points := []otlpNumberDataPoint{}
+		if m.Sum != nil {
+			g.name += " sum"
+			points = m.Sum.DataPoints
+		} else if m.Gauge != nil {
+			g.name += " gauge"
+			points = m.Gauge.DataPoints
+		}
+
+		for _, p := range points {
+			g.values = append(g.values, p.AsDouble)
+		}
+
+		got = append(got, g)
+	}
+
+	want := []group{
+		{"requests sum", []float64{1, 3}},
+		{"inflight gauge", []float64{2, 5}},
+		{"requests gauge", []float64{4}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package exporter
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/nm-morais/demmon-exporter/internal/procfs"
+)
+
+const defaultProcRoot = "/proc"
+
+// ProcessCollector reports the resource usage of the current process, read
+// from /proc/self on Linux: CPU time, memory, file descriptors, threads, I/O
+// and start time. CPU time and I/O are counters.
+type ProcessCollector struct {
+	root string
+
+	mtx   sync.Mutex
+	prev  *totals
+	start float64
+}
+
+// NewProcessCollector returns a ProcessCollector reading the procfs mounted
+// at root, /proc if empty. Conf.ProcessMetrics registers one.
+func NewProcessCollector(root string) *ProcessCollector {
+	if root == "" {
+		root = defaultProcRoot
+	}
+
+	return &ProcessCollector{root: root, prev: newTotals()}
+}
+
+// Describe implements Collector.
+func (c *ProcessCollector) Describe() []Desc {
+	return []Desc{
+		{Name: "process_cpu_user_seconds", Kind: KindCounter, Help: "User CPU time.", Samples: 1},
+		{Name: "process_cpu_system_seconds", Kind: KindCounter, Help: "System CPU time.", Samples: 1},
+		{Name: "process_resident_memory_bytes", Kind: KindGauge, Help: "Resident memory size.", Samples: 1},
+		{Name: "process_virtual_memory_bytes", Kind: KindGauge, Help: "Virtual memory size.", Samples: 1},
+		{Name: "process_open_fds", Kind: KindGauge, Help: "Open file descriptors.", Samples: 1},
+		{Name: "process_max_fds", Kind: KindGauge, Help: "Limit of open file descriptors.", Samples: 1},
+		{Name: "process_threads", Kind: KindGauge, Help: "Number of threads.", Samples: 1},
+		{Name: "process_read_bytes", Kind: KindCounter, Help: "Bytes read from storage.", Samples: 1},
+		{Name: "process_write_bytes", Kind: KindCounter, Help: "Bytes written to storage.", Samples: 1},
+		{Name: "process_start_time_seconds", Kind: KindGauge, Help: "Start time since the epoch.", Samples: 1},
+	}
+}
+
+// Collect implements Collector. The process stat and status files are
+// required; the I/O, limits and fd entries are reported when readable.
+func (c *ProcessCollector) Collect(ctx context.Context, emit EmitFunc) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	self := filepath.Join(c.root, "self")
+
+	stat, err := procfs.ReadProcStat(filepath.Join(self, "stat"))
+	if err != nil {
+		return err
+	}
+
+	status, err := procfs.ReadKeyValues(filepath.Join(self, "status"))
+	if err != nil {
+		return err
+	}
+
+	c.counter(emit, "process_cpu_user_seconds", float64(stat.UTime)/procfs.UserHZ)
+	c.counter(emit, "process_cpu_system_seconds", float64(stat.STime)/procfs.UserHZ)
+	gauge(emit, "process_threads", float64(stat.NumThreads))
+	gauge(emit, "process_virtual_memory_bytes", float64(stat.VSize))
+
+	if rss, err := procfs.ParseKB(status["VmRSS"]); err == nil {
+		gauge(emit, "process_resident_memory_bytes", float64(rss))
+	}
+
+	if fds, err := procfs.CountEntries(filepath.Join(self, "fd")); err == nil {
+		gauge(emit, "process_open_fds", float64(fds))
+	}
+
+	if maxFDs, limited, err := procfs.ReadSoftLimit(filepath.Join(self, "limits"), "Max open files"); err == nil && limited {
+		gauge(emit, "process_max_fds", float64(maxFDs))
+	}
+
+	// io is only readable by the process owner, and may be missing
+	if io, err := procfs.ReadKeyValues(filepath.Join(self, "io")); err == nil {
+		if v, err := procfs.ParseKB(io["read_bytes"]); err == nil {
+			c.counter(emit, "process_read_bytes", float64(v))
+		}
+
+		if v, err := procfs.ParseKB(io["write_bytes"]); err == nil {
+			c.counter(emit, "process_write_bytes", float64(v))
+		}
+	}
+
+	if c.start == 0 {
+		if btime, err := procfs.ReadBootTime(filepath.Join(c.root, "stat")); err == nil {
+			c.start = float64(btime) + float64(stat.StartTime)/procfs.UserHZ
+		}
+	}
+
+	if c.start != 0 {
+		gauge(emit, "process_start_time_seconds", c.start)
+	}
+
+	return nil
+}
+
+// counter emits the increase of a total since the previous collection.
+// Nothing is emitted the first time the total is read.
+func (c *ProcessCollector) counter(emit EmitFunc, name string, total float64) {
+	if d, ok := c.prev.increase(name, total); ok {
+		counter(emit, name, d)
+	}
+}
@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const procFixtures = "internal/procfs/testdata/proc"
+
+// collectedSeries collects c once and returns the emitted fields keyed by
+// metric name and sorted labels, such as "name{a=1,b=2}".
+func collectedSeries(t *testing.T, c Collector) map[string]map[string]interface{} {
+	t.Helper()
+
+	got := map[string]map[string]interface{}{}
+
+	err := c.Collect(context.Background(), func(name string, labels map[string]string, fields map[string]interface{}) {
+		pairs := make([]string, 0, len(labels))
+		for k, v := range labels {
+			pairs = append(pairs, k+"="+v)
+		}
+
+		sort.Strings(pairs)
+
+		key := name
+		if len(pairs) > 0 {
+			key += "{" + strings.Join(pairs, ",") + "}"
+		}
+
+		got[key] = fields
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+// checkSeries compares the collected series with want, which holds the value
+// of the single field of each series.
+func checkSeries(t *testing.T, got map[string]map[string]interface{}, want map[string]float64) {
+	t.Helper()
+
+	for key, value := range want {
+		fields, ok := got[key]
+		if !ok {
+			t.Errorf("%s was not collected", key)
+			continue
+		}
+
+		for _, v := range fields {
+			if v != value {
+				t.Errorf("%s = %v, want %v", key, v, value)
+			}
+		}
+	}
+
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected series %s", key)
+		}
+	}
+}
+
+func TestProcessCollector(t *testing.T) {
+	c := NewProcessCollector(procFixtures)
+
+	described := map[string]bool{}
+	for _, d := range c.Describe() {
+		described[d.Name] = true
+	}
+
+	first := collectedSeries(t, c)
+
+	for name := range first {
+		if !described[name] {
+			t.Errorf("%s was collected but not described", name)
+		}
+	}
+
+	// the first collection only reads the baselines of the counters
+	want := map[string]float64{
+		"process_threads":               8,
+		"process_virtual_memory_bytes":  104857600,
+		"process_resident_memory_bytes": 10485760,
+		"process_open_fds":              3,
+		"process_max_fds":               1024,
+		"process_start_time_seconds":    1700000050,
+	}
+
+	t.Run("first", func(t *testing.T) { checkSeries(t, first, want) })
+
+	// then they report their increase since the previous collection
+	for _, name := range []string{
+		"process_cpu_user_seconds", "process_cpu_system_seconds", "process_read_bytes", "process_write_bytes",
+	} {
+		want[name] = 0
+	}
+
+	t.Run("second", func(t *testing.T) { checkSeries(t, collectedSeries(t, c), want) })
+}
+
+func TestProcessCollectorMissingFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		root    string
+		wantErr bool
+	}{
+		{"no procfs", filepath.Join(t.TempDir(), "proc"), true},
+		{"fixtures", procFixtures, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewProcessCollector(tc.root).Collect(context.Background(), func(string, map[string]string, map[string]interface{}) {})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Collect() error = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,512 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nm-morais/demmon-exporter/internal/generic"
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+	"github.com/sirupsen/logrus"
+)
+
+// ContentTypePrometheus is the content type of the Prometheus text format.
+const ContentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+// promSeries is the cumulative state of a series as seen by Prometheus.
+type promSeries struct {
+	lvs        lv.LabelValues
+	value      float64
+	uppers     []float64
+	cumulative []float64
+	sum        float64
+	count      float64
+	quantiles  []float64
+	estimates  []float64
+}
+
+// promState accumulates what Export drains from the series stores, so that
+// Prometheus sees monotonic counters and histograms even though the stores
+// are reset on every export. Gauges are not reset, so they are read live.
+// The state keeps its series for good, so it is capped by a limiter of its
+// own with the caps of the stores: series past them are folded into the
+// overflow series or dropped, and counted as rejected.
+type promState struct {
+	mtx        sync.Mutex
+	counters   map[string]map[string]*promSeries
+	histograms map[string]map[string]*promSeries
+	limiter    *lv.Limiter
+	reject     rejectFunc
+	collisions map[string]bool // sanitised names already warned about
+}
+
+func newPromState(limiter *lv.Limiter, reject rejectFunc) *promState {
+	return &promState{
+		counters:   map[string]map[string]*promSeries{},
+		histograms: map[string]map[string]*promSeries{},
+		limiter:    limiter,
+		reject:     reject,
+		collisions: map[string]bool{},
+	}
+}
+
+// promSeriesFunc returns the series of m identified by the name and label
+// values, or nil if it is not to be kept.
+type promSeriesFunc func(m map[string]map[string]*promSeries, name string, lvs lv.LabelValues) *promSeries
+
+func promSeriesFor(m map[string]map[string]*promSeries, name string, lvs lv.LabelValues) *promSeries {
+	byLabels, ok := m[name]
+	if !ok {
+		byLabels = map[string]*promSeries{}
+		m[name] = byLabels
+	}
+
+	key := strings.Join(lvs, "\xff")
+
+	series, ok := byLabels[key]
+	if !ok {
+		series = &promSeries{lvs: append(lv.LabelValues{}, lvs...)}
+		byLabels[key] = series
+	}
+
+	return series
+}
+
+// limitedSeriesFor is promSeriesFor for the state itself, whose new series
+// must be admitted by its limiter. The caller holds p.mtx.
+func (p *promState) limitedSeriesFor(m map[string]map[string]*promSeries, name string, lvs lv.LabelValues) *promSeries {
+	if p.limiter == nil {
+		return promSeriesFor(m, name, lvs)
+	}
+
+	if _, ok := m[name][strings.Join(lvs, "\xff")]; ok || p.limiter.Admit(name) {
+		return promSeriesFor(m, name, lvs)
+	}
+
+	if !p.limiter.Fold() {
+		p.reject(name, lvs, lv.ErrSeriesDropped)
+		return nil
+	}
+
+	p.reject(name, lvs, lv.ErrSeriesFolded)
+
+	return promSeriesFor(m, name, lv.OverflowLabelValues)
+}
+
+func mergePromCounters(m map[string]map[string]*promSeries, counters *lv.Space, seriesFor promSeriesFunc) {
+	counters.Walk(func(name string, lvs lv.LabelValues, values []float64) bool {
+		if series := seriesFor(m, name, lvs); series != nil {
+			series.value += sum(values)
+		}
+
+		return true
+	})
+}
+
+func mergePromGauges(m map[string]map[string]*promSeries, gauges *lv.Space) {
+	gauges.Walk(func(name string, lvs lv.LabelValues, values []float64) bool {
+		promSeriesFor(m, name, lvs).value = last(values)
+		return true
+	})
+}
+
+// mergePromSummaries adds the summaries, with the quantiles of their current
+// window and the count and sum of every observation they have seen.
+func mergePromSummaries(m map[string]map[string]*promSeries, s *summaries) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for name, byLabels := range s.series {
+		quantiles := s.confs[name].quantiles
+
+		for _, sr := range byLabels {
+			series := promSeriesFor(m, name, sr.lvs)
+			series.quantiles = quantiles
+			series.estimates = make([]float64, len(quantiles))
+
+			values := sr.summary.Value()
+			empty := sr.summary.Count() == 0
+
+			for i, q := range quantiles {
+				series.estimates[i] = math.NaN()
+				if !empty {
+					series.estimates[i], _ = values[generic.QuantileField(q)].(float64)
+				}
+			}
+
+			count, sum := sr.summary.Totals()
+			series.count, series.sum = float64(count), sum
+		}
+	}
+}
+
+func mergePromHistograms(m map[string]map[string]*promSeries, histograms *lv.Space, seriesFor promSeriesFunc) {
+	histograms.WalkAggregators(func(name string, lvs lv.LabelValues, agg lv.Aggregator) bool {
+		histogram, ok := agg.(*generic.Histogram)
+		if !ok {
+			return true
+		}
+
+		uppers, cumulative, s, c := histogram.Snapshot()
+
+		series := seriesFor(m, name, lvs)
+		if series == nil {
+			return true
+		}
+
+		if len(series.cumulative) != len(cumulative) {
+			series.uppers = uppers
+			series.cumulative = make([]float64, len(cumulative))
+		}
+
+		for i, v := range cumulative {
+			series.cumulative[i] += v
+		}
+
+		series.sum += s
+		series.count += c
+
+		return true
+	})
+}
+
+// drain folds the contents of series stores just reset by Export into the
+// state. The caller holds p.mtx.
+func (p *promState) drain(counters, histograms *lv.Space) {
+	mergePromCounters(p.counters, counters, p.limitedSeriesFor)
+	mergePromHistograms(p.histograms, histograms, p.limitedSeriesFor)
+}
+
+// Handler returns an http.Handler that renders the counters, gauges,
+// histograms and summaries in the Prometheus text exposition format, version
+// 0.0.4. Rendering does not reset anything, so demmon and Prometheus see the
+// same observations. Counters and histograms are cumulative from the first
+// call to Handler. Summaries report the quantiles of their current window,
+// and a count and sum that start over when an idle summary is discarded.
+// Callback gauges and counters are exposed with the values recorded at the
+// last export, as rendering does not call them. Collector series are pushed
+// to the sinks only and are not exposed.
+func (e *Exporter) Handler() http.Handler {
+	e.mtx.Lock()
+	if e.prom == nil {
+		var limiter *lv.Limiter
+		if e.conf.MaxSeriesPerMetric > 0 || e.conf.MaxSeries > 0 {
+			limiter = lv.NewLimiter(e.conf.MaxSeriesPerMetric, e.conf.MaxSeries, !e.conf.DropOverflowSeries)
+		}
+
+		e.prom = newPromState(limiter, e.reject)
+	}
+	p := e.prom
+	e.mtx.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentTypePrometheus)
+
+		bw := bufio.NewWriter(w)
+		e.writePrometheus(bw, p)
+
+		if err := bw.Flush(); err != nil {
+			e.logger.Errorf("Error writing Prometheus exposition: %s", err)
+		}
+	})
+}
+
+// SetHelp sets the help text exposed for the named metric.
+func (e *Exporter) SetHelp(name, help string) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.help[name] = help
+}
+
+// resetSpaces resets the counter and histogram stores and returns their old
+// contents, which are also folded into the Prometheus state if there is one.
+// Gauges keep their values across exports and are not reset.
+func (e *Exporter) resetSpaces() (counters, histograms *lv.Space) {
+	e.mtx.Lock()
+	p := e.prom
+	e.mtx.Unlock()
+
+	if p == nil {
+		return e.counters.Reset(), e.histograms.Reset()
+	}
+
+	// resetting under the state lock makes a concurrent rendering see the
+	// drained observations either in the live stores or in the state
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	counters, histograms = e.counters.Reset(), e.histograms.Reset()
+	p.drain(counters, histograms)
+
+	return counters, histograms
+}
+
+func (e *Exporter) writePrometheus(w io.Writer, p *promState) {
+	p.mtx.Lock()
+
+	counters := copyPromSeries(p.counters)
+	gauges := map[string]map[string]*promSeries{}
+	histograms := copyPromSeries(p.histograms)
+
+	// the live stores are capped by their own limiter, their series are
+	// shown as they are until they are drained into the state
+	mergePromCounters(counters, e.counters, promSeriesFor)
+	mergePromGauges(gauges, e.gauges)
+	mergePromHistograms(histograms, e.histograms, promSeriesFor)
+
+	p.mtx.Unlock()
+
+	summaries := map[string]map[string]*promSeries{}
+	mergePromSummaries(summaries, e.summaries)
+
+	e.mtx.Lock()
+	help := make(map[string]string, len(e.help))
+	for name, h := range e.help {
+		help[name] = h
+	}
+	e.mtx.Unlock()
+
+	// names that sanitise to the same Prometheus name are rejected, the
+	// first one in name order is kept
+	owners := map[string]string{}
+
+	e.writePromFamilies(w, p, "counter", counters, help, owners)
+	e.writePromFamilies(w, p, "gauge", gauges, help, owners)
+	e.writePromFamilies(w, p, "histogram", histograms, help, owners)
+	e.writePromFamilies(w, p, "summary", summaries, help, owners)
+}
+
+func (e *Exporter) writePromFamilies(w io.Writer, p *promState, kind string, families map[string]map[string]*promSeries,
+	help map[string]string, owners map[string]string) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		promName := promMetricName(name)
+
+		if owner, ok := owners[promName]; ok {
+			p.warnCollision(e.logger, promName, owner, name)
+			continue
+		}
+
+		owners[promName] = name
+
+		if h, ok := help[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n", promName, promEscaper.Replace(h))
+		}
+
+		fmt.Fprintf(w, "# TYPE %s %s\n", promName, kind)
+
+		byLabels := families[name]
+
+		keys := make([]string, 0, len(byLabels))
+		for key := range byLabels {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		reserved := ""
+
+		switch kind {
+		case "histogram":
+			reserved = "le"
+		case "summary":
+			reserved = "quantile"
+		}
+
+		for _, key := range keys {
+			series := byLabels[key]
+			tags := p.promTags(e.logger, mergeTags(e.tags, series.lvs), reserved)
+
+			switch kind {
+			case "histogram":
+				writePromHistogram(w, promName, tags, series)
+			case "summary":
+				writePromSummary(w, promName, tags, series)
+			default:
+				fmt.Fprintf(w, "%s%s %s\n", promName, promLabels(tags, "", ""), promValue(series.value))
+			}
+		}
+	}
+}
+
+func writePromHistogram(w io.Writer, promName string, tags map[string]string, series *promSeries) {
+	for i, upper := range series.uppers {
+		le := "+Inf"
+		if !math.IsInf(upper, 1) {
+			le = promValue(upper)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %s\n", promName, promLabels(tags, "le", le), promValue(series.cumulative[i]))
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %s\n", promName, promLabels(tags, "", ""), promValue(series.sum))
+	fmt.Fprintf(w, "%s_count%s %s\n", promName, promLabels(tags, "", ""), promValue(series.count))
+}
+
+func writePromSummary(w io.Writer, promName string, tags map[string]string, series *promSeries) {
+	for i, q := range series.quantiles {
+		fmt.Fprintf(w, "%s%s %s\n", promName, promLabels(tags, "quantile", promValue(q)), promValue(series.estimates[i]))
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %s\n", promName, promLabels(tags, "", ""), promValue(series.sum))
+	fmt.Fprintf(w, "%s_count%s %s\n", promName, promLabels(tags, "", ""), promValue(series.count))
+}
+
+// forget drops the state of the named metric and gives back its room in the
+// limiter.
+func (p *promState) forget(name string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, m := range []map[string]map[string]*promSeries{p.counters, p.histograms} {
+		if p.limiter != nil {
+			admitted := 0
+
+			for _, series := range m[name] {
+				if !lv.IsOverflow(series.lvs) {
+					admitted++
+				}
+			}
+
+			p.limiter.Release(name, admitted)
+		}
+
+		delete(m, name)
+	}
+}
+
+func copyPromSeries(m map[string]map[string]*promSeries) map[string]map[string]*promSeries {
+	c := make(map[string]map[string]*promSeries, len(m))
+
+	for name, byLabels := range m {
+		cByLabels := make(map[string]*promSeries, len(byLabels))
+
+		for key, series := range byLabels {
+			s := *series
+			s.cumulative = append([]float64{}, series.cumulative...)
+			cByLabels[key] = &s
+		}
+
+		c[name] = cByLabels
+	}
+
+	return c
+}
+
+var (
+	promEscaper      = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	promValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// promTags returns the tags keyed by their sanitised Prometheus label names.
+// Of the tags whose names sanitise to the same label, or to the reserved one,
+// only the first one in name order is kept.
+func (p *promState) promTags(logger *logrus.Logger, tags map[string]string, reserved string) map[string]string {
+	sanitised := make(map[string]string, len(tags))
+	owners := make(map[string]string, len(tags))
+
+	for _, k := range sortedKeys(tags) {
+		name := promLabelName(k)
+
+		if name == reserved {
+			p.warnCollision(logger, name, name, k)
+			continue
+		}
+
+		if owner, ok := owners[name]; ok {
+			p.warnCollision(logger, name, owner, k)
+			continue
+		}
+
+		owners[name] = k
+		sanitised[name] = tags[k]
+	}
+
+	return sanitised
+}
+
+// warnCollision logs, once per sanitised name, that name was rejected
+// because it sanitises to a Prometheus name already taken by owner.
+func (p *promState) warnCollision(logger *logrus.Logger, sanitised, owner, name string) {
+	p.mtx.Lock()
+	warned := p.collisions[sanitised+"\xff"+name]
+	p.collisions[sanitised+"\xff"+name] = true
+	p.mtx.Unlock()
+
+	if !warned {
+		logger.Warnf("Not exposing %q to Prometheus: it is sanitised to %s, which %q already uses", name, sanitised, owner)
+	}
+}
+
+// promLabels renders the tags, keyed by valid Prometheus label names, plus an
+// optional extra label, as a sorted Prometheus label set.
+func promLabels(tags map[string]string, extraName, extraValue string) string {
+	if len(tags) == 0 && extraName == "" {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, promValueEscaper.Replace(tags[k])))
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, promValueEscaper.Replace(extraValue)))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// promMetricName replaces the characters Prometheus does not allow in metric
+// names with underscores.
+func promMetricName(name string) string {
+	return promSanitize(name, true)
+}
+
+// promLabelName replaces the characters Prometheus does not allow in label
+// names with underscores.
+func promLabelName(name string) string {
+	return promSanitize(name, false)
+}
+
+func promSanitize(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+
+	b := []byte(name)
+
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9' && i > 0) || (c == ':' && allowColon)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
@@ -0,0 +1,135 @@
+package exporter
+
+import (
+	"context"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape renders the exporter's Prometheus exposition.
+func scrape(t *testing.T, e *Exporter) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	e.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != ContentTypePrometheus {
+		t.Errorf("Content-Type = %q, want %q", ct, ContentTypePrometheus)
+	}
+
+	return rec.Body.String()
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	const tags = `host="h1",service="svc"`
+
+	for _, tc := range []struct {
+		name  string
+		setup func(e *Exporter)
+		want  []string
+	}{
+		{
+			name: "histogram buckets",
+			setup: func(e *Exporter) {
+				h := e.NewHistogram("latency", 1, []float64{1, 5})
+				for _, v := range []float64{0.5, 3, 10} {
+					h.Observe(v)
+				}
+			},
+			want: []string{
+				"# TYPE latency histogram",
+				`latency_bucket{` + tags + `,le="1"} 1`,
+				`latency_bucket{` + tags + `,le="5"} 2`,
+				`latency_bucket{` + tags + `,le="+Inf"} 3`,
+				`latency_sum{` + tags + `} 13.5`,
+				`latency_count{` + tags + `} 3`,
+			},
+		},
+		{
+			name: "explicit +Inf bound",
+			setup: func(e *Exporter) {
+				e.NewHistogram("size", 1, []float64{0.25, math.Inf(1)}).Observe(1)
+			},
+			want: []string{
+				`size_bucket{` + tags + `,le="0.25"} 0`,
+				`size_bucket{` + tags + `,le="+Inf"} 1`,
+				`size_count{` + tags + `} 1`,
+			},
+		},
+		{
+			name: "histogram across exports",
+			setup: func(e *Exporter) {
+				h := e.NewHistogram("latency", 1, []float64{1})
+				h.Observe(0.5)
+
+				if err := e.export(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+
+				h.Observe(2)
+			},
+			want: []string{
+				`latency_bucket{` + tags + `,le="1"} 1`,
+				`latency_bucket{` + tags + `,le="+Inf"} 2`,
+			},
+		},
+		{
+			name: "summary",
+			setup: func(e *Exporter) {
+				e.NewSummary("rtt", 1, []float64{0.5}, 0).Observe(2)
+			},
+			want: []string{
+				"# TYPE rtt summary",
+				`rtt{` + tags + `,quantile="0.5"} 2`,
+				`rtt_sum{` + tags + `} 2`,
+				`rtt_count{` + tags + `} 1`,
+			},
+		},
+		{
+			name: "summary after its window",
+			setup: func(e *Exporter) {
+				e.NewSummary("rtt", 1, []float64{0.5}, 0).Observe(2)
+
+				if err := e.export(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{
+				`rtt{` + tags + `,quantile="0.5"} NaN`,
+				`rtt_count{` + tags + `} 1`,
+			},
+		},
+		{
+			name: "callback gauge",
+			setup: func(e *Exporter) {
+				if err := e.RegisterGaugeFunc("temperature", 1, nil, func() float64 { return 21 }); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := e.export(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{
+				"# TYPE temperature gauge",
+				`temperature{` + tags + `} 21`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestExporter(t, &Conf{})
+			e.Handler()
+			tc.setup(e)
+
+			got := scrape(t, e)
+
+			for _, line := range tc.want {
+				if !strings.Contains(got, line+"\n") {
+					t.Errorf("missing %s in\n%s", line, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrMetricConflict is returned when a metric is registered under the name of
+// a metric of another kind or with other parameters.
+var ErrMetricConflict = errors.New("metric already registered with different parameters")
+
+// MetricInfo describes a registered metric. Labels are the declared label
+// keys of vectors and the label keys of callback metrics, Bounds the bucket
+// bounds of histograms, and Quantiles and MaxAge the parameters of summaries.
+type MetricInfo struct {
+	Name      string
+	Kind      Kind
+	Samples   int
+	Labels    []string
+	Bounds    []float64
+	Quantiles []float64
+	MaxAge    time.Duration
+}
+
+// conflict returns an error describing how other differs from the metric
+// already registered as m. Labels are compared by the callers that declare
+// them.
+func (m MetricInfo) conflict(other MetricInfo) error {
+	switch {
+	case m.Kind != other.Kind:
+		return fmt.Errorf("%w: %s is a %s, not a %s", ErrMetricConflict, m.Name, m.Kind, other.Kind)
+	case m.Samples != other.Samples:
+		return fmt.Errorf("%w: %s stores %d samples, not %d", ErrMetricConflict, m.Name, m.Samples, other.Samples)
+	case !equalFloats(m.Bounds, other.Bounds):
+		return fmt.Errorf("%w: %s has bucket bounds %v, not %v", ErrMetricConflict, m.Name, m.Bounds, other.Bounds)
+	case !equalFloats(m.Quantiles, other.Quantiles):
+		return fmt.Errorf("%w: %s has quantiles %v, not %v", ErrMetricConflict, m.Name, m.Quantiles, other.Quantiles)
+	case m.MaxAge != other.MaxAge:
+		return fmt.Errorf("%w: %s has a max age of %s, not %s", ErrMetricConflict, m.Name, m.MaxAge, other.MaxAge)
+	}
+
+	return nil
+}
+
+// labelConflict returns an error if labels are not the label keys of m.
+func (m MetricInfo) labelConflict(labels []string) error {
+	if len(m.Labels) != len(labels) {
+		return fmt.Errorf("%w: %s has label keys %v, not %v", ErrMetricConflict, m.Name, m.Labels, labels)
+	}
+
+	for i := range labels {
+		if m.Labels[i] != labels[i] {
+			return fmt.Errorf("%w: %s has label keys %v, not %v", ErrMetricConflict, m.Name, m.Labels, labels)
+		}
+	}
+
+	return nil
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// metricEntry is a registered metric. handle is the Counter, Gauge, Histogram
+// or Summary returned to every caller that registers the metric, and is nil
+// for metrics only registered by callbacks or collectors. collectors is the
+// number of registered collectors that describe the metric. Handles stop
+// recording observations once the metric is unregistered.
+type metricEntry struct {
+	info       MetricInfo
+	handle     interface{}
+	collectors int
+
+	// mtx is held for reading by observations in progress, which removal
+	// waits for, so that none can recreate a series after it is deleted
+	mtx     sync.RWMutex
+	removed bool
+}
+
+// remove marks the metric as unregistered and calls deleteSeries, if not nil,
+// once the observations in progress are done.
+func (m *metricEntry) remove(deleteSeries func()) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.removed = true
+
+	if deleteSeries != nil {
+		deleteSeries()
+	}
+}
+
+// registerLocked records a metric in the registry and returns its entry. A
+// metric registered again under the same name keeps its entry, provided it is
+// of the same kind and has the same parameters. The caller holds e.mtx.
+func (e *Exporter) registerLocked(info MetricInfo) (*metricEntry, error) {
+	if m, ok := e.metrics[info.Name]; ok {
+		if err := m.info.conflict(info); err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	}
+
+	m := &metricEntry{info: info}
+	e.metrics[info.Name] = m
+
+	return m, nil
+}
+
+// registerHandleLocked registers the metric described by info and returns its
+// entry. A metric that already has a handle must have been declared with the
+// same label keys; otherwise it takes info's. The caller holds e.mtx.
+func (e *Exporter) registerHandleLocked(info MetricInfo) (*metricEntry, error) {
+	m, err := e.registerLocked(info)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.handle == nil {
+		m.info.Labels = info.Labels
+		return m, nil
+	}
+
+	if err := m.info.labelConflict(info.Labels); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Metrics returns the registered metrics, sorted by name.
+func (e *Exporter) Metrics() []MetricInfo {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	infos := make([]MetricInfo, 0, len(e.metrics))
+
+	for _, m := range e.metrics {
+		info := m.info
+		info.Labels = append([]string(nil), info.Labels...)
+		info.Bounds = append([]float64(nil), info.Bounds...)
+		info.Quantiles = append([]float64(nil), info.Quantiles...)
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos
+}
+
+// Unregister removes the named metric and reports whether it was registered.
+// Its series are deleted and no longer exported, and its handles stop
+// recording observations. Its demmon bucket is uninstalled as well if
+// UninstallBucketsOnUnregister is set; the error of an uninstall, such as
+// ErrUninstallUnsupported, is logged.
+func (e *Exporter) Unregister(name string) bool {
+	e.mtx.Lock()
+
+	m, ok := e.metrics[name]
+	if !ok {
+		e.mtx.Unlock()
+		return false
+	}
+
+	delete(e.metrics, name)
+	delete(e.help, name)
+
+	funcs := e.funcs[:0]
+
+	for _, f := range e.funcs {
+		if f.name != name {
+			funcs = append(funcs, f)
+		}
+	}
+
+	for i := len(funcs); i < len(e.funcs); i++ {
+		e.funcs[i] = nil
+	}
+
+	e.funcs = funcs
+
+	// e.mtx is still held so that the metric cannot be registered again
+	// before its series are gone
+	m.remove(func() {
+		switch m.info.Kind {
+		case KindCounter:
+			e.counters.Delete(name)
+		case KindGauge:
+			e.gauges.Delete(name)
+		case KindHistogram:
+			e.histograms.Delete(name)
+		case KindSummary:
+			e.summaries.unregister(name)
+		case KindUntyped:
+		}
+
+		if e.timings != nil {
+			e.timings.Delete(name)
+		}
+	})
+
+	e.boundsMtx.Lock()
+	delete(e.histBounds, name)
+	e.boundsMtx.Unlock()
+
+	p := e.prom
+	e.mtx.Unlock()
+
+	if p != nil {
+		p.forget(name)
+	}
+
+	if e.conf.UninstallBucketsOnUnregister {
+		if err := e.uninstallBucket(name); err != nil {
+			e.logger.Errorf("Error uninstalling bucket %s: %s", name, err)
+		}
+	}
+
+	return true
+}
+
+// registeredOnly returns the series in bp whose metric is registered.
+func (e *Exporter) registeredOnly(bp []Series) []Series {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	kept := bp[:0]
+
+	for _, s := range bp {
+		if _, ok := e.metrics[s.MeasurementName]; ok {
+			kept = append(kept, s)
+		}
+	}
+
+	return kept
+}
@@ -0,0 +1,409 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+	"go.uber.org/atomic"
+)
+
+func newTestExporter(t *testing.T, conf *Conf) *Exporter {
+	t.Helper()
+
+	conf.Offline = true
+	conf.LogFolder = t.TempDir()
+	conf.LogFile = "exporter.log"
+
+	e, err, _ := New(conf, "h1", "svc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = e.Close() })
+
+	return e
+}
+
+func countSeries(spaces ...*lv.Space) int {
+	n := 0
+
+	for _, s := range spaces {
+		s.WalkAggregators(func(string, lv.LabelValues, lv.Aggregator) bool {
+			n++
+			return true
+		})
+	}
+
+	return n
+}
+
+// Observations in flight when a metric is unregistered must not recreate the
+// series Unregister deleted.
+func TestUnregisterDuringObservations(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+
+	for round := 0; round < 50; round++ {
+		h := e.NewHistogram("latency", 1, []float64{1})
+		c := e.NewCounter("requests", 1)
+
+		var wg sync.WaitGroup
+
+		stop := make(chan struct{})
+
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						h.Observe(0.5)
+						c.Add(1)
+					}
+				}
+			}()
+		}
+
+		for countSeries(e.histograms, e.counters) < 2 {
+			runtime.Gosched()
+		}
+
+		e.Unregister("latency")
+		e.Unregister("requests")
+
+		close(stop)
+		wg.Wait()
+
+		if n := countSeries(e.histograms, e.counters); n != 0 {
+			t.Fatalf("round %d: %d series left after Unregister", round, n)
+		}
+	}
+}
+
+type testCollector struct{ descs []Desc }
+
+func (c *testCollector) Describe() []Desc { return c.descs }
+
+func (c *testCollector) Collect(context.Context, EmitFunc) error { return nil }
+
+// valueCollector is a collector that is not a pointer, nor comparable.
+type valueCollector []Desc
+
+func (c valueCollector) Describe() []Desc { return c }
+
+func (c valueCollector) Collect(context.Context, EmitFunc) error { return nil }
+
+// connsCollector emits a counter series per connection.
+type connsCollector struct{ conns []string }
+
+func (c *connsCollector) Describe() []Desc {
+	return []Desc{{Name: "conns", Kind: KindCounter, Samples: 1}}
+}
+
+func (c *connsCollector) Collect(_ context.Context, emit EmitFunc) error {
+	for _, conn := range c.conns {
+		emit("conns", map[string]string{"conn": conn}, map[string]interface{}{"count": 1.0})
+	}
+
+	return nil
+}
+
+func registered(e *Exporter) map[string]Kind {
+	kinds := map[string]Kind{}
+	for _, info := range e.Metrics() {
+		kinds[info.Name] = info.Kind
+	}
+
+	return kinds
+}
+
+func TestUnregisterCollectorKeepsSharedMetrics(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+	e.NewCounter("shared", 1)
+
+	c := &testCollector{descs: []Desc{
+		{Name: "shared", Kind: KindCounter, Samples: 1},
+		{Name: "own", Kind: KindGauge, Samples: 1},
+	}}
+	if err := e.RegisterCollector(c, CollectorOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := &testCollector{descs: []Desc{{Name: "common", Kind: KindGauge, Samples: 1}}}
+	also := &testCollector{descs: []Desc{{Name: "common", Kind: KindGauge, Samples: 1}}}
+
+	for _, c := range []Collector{other, also} {
+		if err := e.RegisterCollector(c, CollectorOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.UnregisterCollector(c)
+	e.UnregisterCollector(other)
+
+	got := registered(e)
+	if _, ok := got["own"]; ok {
+		t.Error("own is still registered after its collector was unregistered")
+	}
+
+	for _, name := range []string{"shared", "common"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s was unregistered along with a collector", name)
+		}
+	}
+}
+
+func TestRegisterCollectorConflicts(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+	e.NewCounter("requests", 1)
+
+	for _, tc := range []struct {
+		name    string
+		descs   []Desc
+		wantErr error
+	}{
+		{"other kind", []Desc{{Name: "fresh", Kind: KindGauge, Samples: 1}, {Name: "requests", Kind: KindGauge, Samples: 1}}, ErrMetricConflict},
+		{
+			"other samples",
+			[]Desc{{Name: "fresh", Kind: KindGauge, Samples: 1}, {Name: "requests", Kind: KindCounter, Samples: 5}},
+			ErrMetricConflict,
+		},
+		{"described twice", []Desc{{Name: "fresh", Kind: KindGauge, Samples: 1}, {Name: "fresh", Kind: KindCounter, Samples: 1}}, ErrInvalidDesc},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := e.RegisterCollector(&testCollector{descs: tc.descs}, CollectorOpts{})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("RegisterCollector() error = %v, want %v", err, tc.wantErr)
+			}
+
+			if _, ok := registered(e)["fresh"]; ok {
+				t.Error("a metric of a rejected collector is registered")
+			}
+		})
+	}
+}
+
+func TestRegisterCollectorRejectsNonPointers(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+
+	var nilCollector *testCollector
+
+	for _, c := range []Collector{valueCollector{{Name: "value", Kind: KindGauge, Samples: 1}}, nilCollector} {
+		if err := e.RegisterCollector(c, CollectorOpts{}); !errors.Is(err, ErrInvalidCollector) {
+			t.Errorf("RegisterCollector(%T) error = %v, want %v", c, err, ErrInvalidCollector)
+		}
+
+		if e.UnregisterCollector(c) {
+			t.Errorf("UnregisterCollector(%T) = true, want false", c)
+		}
+	}
+
+	if _, ok := registered(e)["value"]; ok {
+		t.Error("a metric of a rejected collector is registered")
+	}
+}
+
+func TestCollectedSeriesLimited(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		drop bool
+		want []string
+	}{
+		{"folded", false, []string{"a", "b", ""}},
+		{"dropped", true, []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestExporter(t, &Conf{MaxSeriesPerMetric: 2, DropOverflowSeries: tc.drop})
+
+			c := &connsCollector{conns: []string{"a", "b", "c"}}
+			if err := e.RegisterCollector(c, CollectorOpts{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// the series admitted on the first collection are kept on the next
+			for i := 0; i < 2; i++ {
+				var got []string
+
+				for _, sr := range e.gatherCollectors(time.Now()) {
+					if sr.TSTags[lv.OverflowLabel] == "true" {
+						got = append(got, "")
+						continue
+					}
+
+					got = append(got, sr.TSTags["conn"])
+				}
+
+				if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+					t.Errorf("collection %d: series of conns = %q, want %q", i, got, tc.want)
+				}
+			}
+
+			if n := e.Stats().Rejected["conns"]; n != 1 {
+				t.Errorf("%d series of conns were rejected, want 1", n)
+			}
+
+			// the room of an unregistered collector is given back
+			e.UnregisterCollector(c)
+
+			other := &connsCollector{conns: []string{"x", "y"}}
+			if err := e.RegisterCollector(other, CollectorOpts{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if bp := e.gatherCollectors(time.Now()); len(bp) != 2 || bp[0].TSTags["conn"] == "" {
+				t.Errorf("series of another collector = %v, want its own two", bp)
+			}
+		})
+	}
+}
+
+func TestIntervalCollectionsStartAtThePreviousOne(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+
+	if err := e.RegisterCollector(&connsCollector{conns: []string{"a"}}, CollectorOpts{Interval: 5 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	var bp []Series
+
+	for deadline := time.Now().Add(time.Second); len(bp) < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+
+		bp = append(bp, e.gatherCollectors(time.Now())...)
+	}
+
+	if len(bp) < 3 {
+		t.Fatalf("collected %d series, want at least 3", len(bp))
+	}
+
+	if bp[0].Start.IsZero() || !bp[0].Start.Before(bp[0].Values[0].TS) {
+		t.Errorf("first collection starts at %v, want a time before it", bp[0].Start)
+	}
+
+	for i := 1; i < len(bp); i++ {
+		if !bp[i].Start.Equal(bp[i-1].Values[0].TS) {
+			t.Errorf("collection %d starts at %v, want the previous one at %v", i, bp[i].Start, bp[i-1].Values[0].TS)
+		}
+	}
+}
+
+func TestRegisterFuncDuplicates(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+
+	calls := atomic.NewInt32(0)
+	fn := func() float64 {
+		calls.Inc()
+		return 10
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := e.RegisterCounterFunc("jobs", 1, []string{"queue", "a"}, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.RegisterCounterFunc("jobs", 1, []string{"queue", "b"}, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		register    func() error
+		wantErrText string
+	}{
+		{"other label keys", func() error { return e.RegisterCounterFunc("jobs", 1, []string{"shard", "1"}, fn) }, "label keys"},
+		{"no labels", func() error { return e.RegisterCounterFunc("jobs", 1, nil, fn) }, "label keys"},
+		{"other kind", func() error { return e.RegisterGaugeFunc("jobs", 1, []string{"queue", "a"}, fn) }, "is a"},
+		{"other samples", func() error { return e.RegisterCounterFunc("jobs", 2, []string{"queue", "a"}, fn) }, "samples"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.register()
+			if !errors.Is(err, ErrMetricConflict) || !strings.Contains(err.Error(), tc.wantErrText) {
+				t.Errorf("register error = %v, want a conflict on %s", err, tc.wantErrText)
+			}
+		})
+	}
+
+	e.collectFuncs()
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("callbacks were called %d times, want once per series", n)
+	}
+}
+
+// funcValues returns the observations recorded under a metric name.
+func funcValues(s *lv.Space, name string) []float64 {
+	var values []float64
+
+	s.Walk(func(n string, _ lv.LabelValues, observations []float64) bool {
+		if n == name {
+			values = append(values, observations...)
+		}
+
+		return true
+	})
+
+	return values
+}
+
+func TestCounterFuncBaseline(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+
+	total := atomic.NewFloat64(100)
+	if err := e.RegisterCounterFunc("jobs", 1, nil, total.Load); err != nil {
+		t.Fatal(err)
+	}
+
+	e.collectFuncs()
+
+	if got := funcValues(e.counters, "jobs"); len(got) != 0 {
+		t.Errorf("first read recorded %v, want only a baseline", got)
+	}
+
+	total.Store(104)
+	e.collectFuncs()
+
+	if got := funcValues(e.counters, "jobs"); len(got) != 1 || got[0] != 4 {
+		t.Errorf("second read recorded %v, want [4]", got)
+	}
+}
+
+func TestSkippedGaugeFuncDropsValue(t *testing.T) {
+	e := newTestExporter(t, &Conf{})
+
+	fail := atomic.NewBool(false)
+	fn := func() float64 {
+		if fail.Load() {
+			panic("sensor unavailable")
+		}
+
+		return 21
+	}
+
+	if err := e.RegisterGaugeFunc("temperature", 1, []string{"room", "a"}, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	e.collectFuncs()
+
+	if got := funcValues(e.gauges, "temperature"); len(got) != 1 || got[0] != 21 {
+		t.Fatalf("recorded %v, want [21]", got)
+	}
+
+	fail.Store(true)
+	e.collectFuncs()
+
+	if got := funcValues(e.gauges, "temperature"); len(got) != 0 {
+		t.Errorf("a skipped call left %v, want no value", got)
+	}
+}
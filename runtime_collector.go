@@ -0,0 +1,160 @@
+package exporter
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/nm-morais/demmon-exporter/internal/generic"
+)
+
+// DefaultRuntimeBounds are the bucket upper bounds, in seconds, of the
+// histograms reported by RuntimeCollector.
+var DefaultRuntimeBounds = []float64{1e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 5e-2, 0.1, 0.5, 1}
+
+// RuntimeCollector reports the Go runtime metrics: goroutines, GOMAXPROCS,
+// heap usage, GC cycles and GC pauses, plus scheduling latencies when built
+// with Go 1.17 or later, where runtime/metrics is read instead of
+// runtime.MemStats. Histograms use the exporter's bucket fields.
+type RuntimeCollector struct {
+	mtx        sync.Mutex
+	cumulative bool
+	bounds     []float64
+	state      runtimeState
+}
+
+// NewRuntimeCollector returns a RuntimeCollector; cumulativeHistograms has
+// the same meaning as Conf.CumulativeHistograms. Conf.RuntimeMetrics
+// registers one.
+func NewRuntimeCollector(cumulativeHistograms bool) *RuntimeCollector {
+	return &RuntimeCollector{
+		cumulative: cumulativeHistograms,
+		bounds:     DefaultRuntimeBounds,
+	}
+}
+
+// Describe implements Collector.
+func (c *RuntimeCollector) Describe() []Desc {
+	descs := []Desc{
+		{Name: "go_goroutines", Kind: KindGauge, Help: "Number of goroutines.", Samples: 1},
+		{Name: "go_gomaxprocs", Kind: KindGauge, Help: "Value of GOMAXPROCS.", Samples: 1},
+		{Name: "go_heap_alloc_bytes", Kind: KindGauge, Help: "Bytes of allocated heap objects.", Samples: 1},
+		{Name: "go_heap_inuse_bytes", Kind: KindGauge, Help: "Bytes in in-use heap spans.", Samples: 1},
+		{Name: "go_heap_objects", Kind: KindGauge, Help: "Number of allocated heap objects.", Samples: 1},
+		{Name: "go_gc_cycles", Kind: KindCounter, Help: "Completed GC cycles.", Samples: 1},
+		{Name: "go_gc_pause_seconds", Kind: KindHistogram, Help: "Stop-the-world GC pauses.", Samples: 1},
+	}
+
+	return append(descs, runtimeExtraDescs...)
+}
+
+// Collect implements Collector.
+func (c *RuntimeCollector) Collect(ctx context.Context, emit EmitFunc) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	gauge(emit, "go_gomaxprocs", float64(runtime.GOMAXPROCS(0)))
+
+	return c.read(emit)
+}
+
+func gauge(emit EmitFunc, name string, value float64) {
+	emit(name, nil, map[string]interface{}{"value": value})
+}
+
+func counter(emit EmitFunc, name string, delta float64) {
+	emit(name, nil, map[string]interface{}{"count": delta})
+}
+
+// totals remembers the totals read by a collector, keyed by series, so that
+// it can report their increase as counters.
+type totals struct {
+	values map[string]float64
+	read   map[string]bool
+}
+
+func newTotals() *totals {
+	return &totals{values: map[string]float64{}, read: map[string]bool{}}
+}
+
+// increase returns the increase of the total since it was last read. A total
+// lower than the previous one is taken as a reset of its source. The first
+// time a total is read it only becomes the baseline and false is returned, as
+// its increase since the source started, e.g. since boot, does not belong to
+// the current collection.
+func (t *totals) increase(key string, total float64) (float64, bool) {
+	prev, seen := t.values[key]
+
+	d := total - prev
+	if d < 0 {
+		d = total
+	}
+
+	t.values[key] = total
+	t.read[key] = true
+
+	return d, seen
+}
+
+// prune forgets the totals that were not read since the previous prune, such
+// as those of devices that were removed.
+func (t *totals) prune() {
+	for key := range t.values {
+		if !t.read[key] {
+			delete(t.values, key)
+		}
+	}
+
+	t.read = map[string]bool{}
+}
+
+// runtimeHistogram folds observations into the collector's bucket bounds,
+// with a last +Inf bucket.
+type runtimeHistogram struct {
+	bounds []float64
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+func newRuntimeHistogram(bounds []float64) *runtimeHistogram {
+	return &runtimeHistogram{bounds: bounds, counts: make([]float64, len(bounds)+1)}
+}
+
+// add records n observations no greater than upper, whose sum is sum.
+func (h *runtimeHistogram) add(upper, n, sum float64) {
+	i := 0
+	for i < len(h.bounds) && upper > h.bounds[i] {
+		i++
+	}
+
+	h.counts[i] += n
+	h.sum += sum
+	h.count += n
+}
+
+func (h *runtimeHistogram) fields(cumulative bool) map[string]interface{} {
+	fields := make(map[string]interface{}, len(h.counts)+2)
+
+	var acc float64
+
+	for i, v := range h.counts {
+		upper := math.Inf(1)
+		if i < len(h.bounds) {
+			upper = h.bounds[i]
+		}
+
+		if cumulative {
+			acc += v
+			v = acc
+		}
+
+		fields[generic.BucketField(upper, cumulative)] = v
+	}
+
+	fields[generic.SumField] = h.sum
+	fields[generic.CountField] = h.count
+
+	return fields
+}
@@ -0,0 +1,47 @@
+//go:build !go1.17
+// +build !go1.17
+
+package exporter
+
+import "runtime"
+
+var runtimeExtraDescs []Desc
+
+// runtimeState holds the number of GC cycles read by the previous
+// collection, which the counter and the pause histogram are reported
+// relative to.
+type runtimeState struct {
+	numGC uint32
+}
+
+func (c *RuntimeCollector) read(emit EmitFunc) error {
+	var ms runtime.MemStats
+
+	runtime.ReadMemStats(&ms)
+
+	gauge(emit, "go_goroutines", float64(runtime.NumGoroutine()))
+	gauge(emit, "go_heap_alloc_bytes", float64(ms.HeapAlloc))
+	gauge(emit, "go_heap_inuse_bytes", float64(ms.HeapInuse))
+	gauge(emit, "go_heap_objects", float64(ms.HeapObjects))
+
+	newGCs := ms.NumGC - c.state.numGC
+	counter(emit, "go_gc_cycles", float64(newGCs))
+
+	// PauseNs only holds the most recent pauses
+	if newGCs > uint32(len(ms.PauseNs)) {
+		newGCs = uint32(len(ms.PauseNs))
+	}
+
+	h := newRuntimeHistogram(c.bounds)
+
+	for i := uint32(0); i < newGCs; i++ {
+		pause := float64(ms.PauseNs[(ms.NumGC-i+uint32(len(ms.PauseNs))-1)%uint32(len(ms.PauseNs))]) / 1e9
+		h.add(pause, 1, pause)
+	}
+
+	c.state.numGC = ms.NumGC
+
+	emit("go_gc_pause_seconds", nil, h.fields(c.cumulative))
+
+	return nil
+}
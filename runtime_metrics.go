@@ -0,0 +1,120 @@
+//go:build go1.17
+// +build go1.17
+
+package exporter
+
+import (
+	"math"
+	"runtime/metrics"
+)
+
+var runtimeExtraDescs = []Desc{
+	{Name: "go_sched_latency_seconds", Kind: KindHistogram, Help: "Time goroutines spent runnable before running.", Samples: 1},
+}
+
+var runtimeSamples = []string{
+	"/sched/goroutines:goroutines",
+	"/memory/classes/heap/objects:bytes",
+	"/memory/classes/heap/unused:bytes",
+	"/gc/heap/objects:objects",
+	"/gc/cycles/total:gc-cycles",
+	"/gc/pauses:seconds",
+	"/sched/latencies:seconds",
+}
+
+// runtimeState holds the totals read by the previous collection, which the
+// counter and histograms are reported relative to.
+type runtimeState struct {
+	samples  []metrics.Sample
+	gcCycles uint64
+	hists    map[string][]uint64
+}
+
+func (c *RuntimeCollector) read(emit EmitFunc) error {
+	s := &c.state
+
+	if s.samples == nil {
+		s.samples = make([]metrics.Sample, len(runtimeSamples))
+		for i, name := range runtimeSamples {
+			s.samples[i].Name = name
+		}
+
+		s.hists = map[string][]uint64{}
+	}
+
+	metrics.Read(s.samples)
+
+	values := make(map[string]metrics.Value, len(s.samples))
+	for _, sample := range s.samples {
+		values[sample.Name] = sample.Value
+	}
+
+	if v := values["/sched/goroutines:goroutines"]; v.Kind() == metrics.KindUint64 {
+		gauge(emit, "go_goroutines", float64(v.Uint64()))
+	}
+
+	objects, unused := values["/memory/classes/heap/objects:bytes"], values["/memory/classes/heap/unused:bytes"]
+	if objects.Kind() == metrics.KindUint64 {
+		gauge(emit, "go_heap_alloc_bytes", float64(objects.Uint64()))
+
+		if unused.Kind() == metrics.KindUint64 {
+			gauge(emit, "go_heap_inuse_bytes", float64(objects.Uint64()+unused.Uint64()))
+		}
+	}
+
+	if v := values["/gc/heap/objects:objects"]; v.Kind() == metrics.KindUint64 {
+		gauge(emit, "go_heap_objects", float64(v.Uint64()))
+	}
+
+	if v := values["/gc/cycles/total:gc-cycles"]; v.Kind() == metrics.KindUint64 {
+		counter(emit, "go_gc_cycles", float64(v.Uint64()-s.gcCycles))
+		s.gcCycles = v.Uint64()
+	}
+
+	c.emitHistogram(emit, "go_gc_pause_seconds", values["/gc/pauses:seconds"])
+	c.emitHistogram(emit, "go_sched_latency_seconds", values["/sched/latencies:seconds"])
+
+	return nil
+}
+
+// emitHistogram reports the observations of a runtime histogram since the
+// previous collection, in the collector's buckets. Each runtime bucket is
+// counted in the first bucket whose bound is not below its upper edge, and
+// the sum is estimated from the bucket midpoints.
+func (c *RuntimeCollector) emitHistogram(emit EmitFunc, name string, v metrics.Value) {
+	if v.Kind() != metrics.KindFloat64Histogram {
+		return
+	}
+
+	rh := v.Float64Histogram()
+	prev := c.state.hists[name]
+
+	if len(prev) != len(rh.Counts) {
+		prev = make([]uint64, len(rh.Counts))
+	}
+
+	h := newRuntimeHistogram(c.bounds)
+
+	for i, n := range rh.Counts {
+		delta := float64(n - prev[i])
+		if delta == 0 {
+			continue
+		}
+
+		lower, upper := rh.Buckets[i], rh.Buckets[i+1]
+
+		mid := (lower + upper) / 2
+		switch {
+		case math.IsInf(lower, -1):
+			mid = upper
+		case math.IsInf(upper, 1):
+			mid = lower
+		}
+
+		h.add(upper, delta, delta*mid)
+	}
+
+	c.state.hists[name] = append(prev[:0], rh.Counts...)
+
+	emit(name, nil, h.fields(c.cumulative))
+}
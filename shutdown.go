@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned by Export and Shutdown once the exporter is shut down.
+var ErrClosed = errors.New("exporter is shut down")
+
+// ErrUninstallUnsupported is returned when buckets are to be uninstalled but
+// the demmon client cannot remove them.
+var ErrUninstallUnsupported = errors.New("the demmon client cannot uninstall buckets")
+
+// bucketUninstaller is implemented by demmon clients that can remove buckets.
+type bucketUninstaller interface {
+	UninstallBucket(name string) error
+}
+
+// Shutdown stops the export loops, waits for an in-flight export to finish and
+// exports what was observed since, within the deadline of ctx. Batches that
+// are still waiting for a retry are moved to the spool. It then uninstalls the
+// buckets if UninstallBucketsOnClose is set, and closes the demmon connection,
+// the spool and the sinks the exporter opened. The exporter cannot be used
+// afterwards.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mtx.Lock()
+	if e.closed {
+		e.mtx.Unlock()
+		return ErrClosed
+	}
+
+	e.closed = true
+	e.mtx.Unlock()
+
+	close(e.done)
+
+	var errs []error
+
+	loopsDone := make(chan struct{})
+
+	go func() {
+		e.loops.Wait()
+		close(loopsDone)
+	}()
+
+	select {
+	case <-loopsDone:
+		if err := e.export(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	if e.retries != nil {
+		for _, b := range e.retries.Drain() {
+			e.spoolBatch(b)
+		}
+	}
+
+	if e.conf.UninstallBucketsOnClose {
+		if err := e.uninstallBuckets(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if e.client != nil {
+		e.client.Disconnect()
+	}
+
+	if e.statsd != nil {
+		if err := e.statsd.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if e.fileSink != nil {
+		if err := e.fileSink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if e.spool != nil {
+		if err := e.spool.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// Close shuts the exporter down without a deadline.
+func (e *Exporter) Close() error {
+	return e.Shutdown(context.Background())
+}
+
+// uninstallBuckets removes the buckets installed by this exporter.
+func (e *Exporter) uninstallBuckets() error {
+	e.mtx.Lock()
+	names := make([]string, 0, len(e.installed))
+
+	for name := range e.installed {
+		names = append(names, name)
+	}
+	e.mtx.Unlock()
+
+	var lastErr error
+
+	for _, name := range names {
+		if err := e.uninstallBucket(name); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// uninstallBucket removes the named bucket if this exporter installed it. It
+// fails with ErrUninstallUnsupported if the client cannot remove buckets.
+func (e *Exporter) uninstallBucket(name string) error {
+	e.mtx.Lock()
+	installed := e.installed[name]
+	e.mtx.Unlock()
+
+	if !installed || e.client == nil {
+		return nil
+	}
+
+	u, ok := interface{}(e.client).(bucketUninstaller)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUninstallUnsupported, name)
+	}
+
+	e.logger.Infof("uninstalling bucket %s...", name)
+
+	if err := u.UninstallBucket(name); err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	delete(e.installed, name)
+	e.mtx.Unlock()
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	client "github.com/nm-morais/demmon-client/pkg"
+	"github.com/nm-morais/demmon-exporter/internal/series"
+)
+
+// Kind is the type of metric a series was produced by.
+type Kind = series.Kind
+
+const (
+	KindUntyped   = series.KindUntyped
+	KindCounter   = series.KindCounter
+	KindGauge     = series.KindGauge
+	KindHistogram = series.KindHistogram
+	KindSummary   = series.KindSummary
+)
+
+// Series is an exported time series along with the kind of metric that
+// produced it.
+type Series = series.Series
+
+// Sink is a destination for batches of exported series. Push must not keep
+// batch after returning.
+type Sink = series.Sink
+
+// ErrDuplicateSink is returned by New for sinks that have the same name.
+var ErrDuplicateSink = errors.New("duplicate sink name")
+
+// NamedSink is implemented by sinks that have a name of their own. Batches
+// deferred to the retry queue or the spool record the names of the sinks they
+// are still due to, so a name must identify its sink across restarts. Sinks
+// that do not implement NamedSink are named after their type and their
+// position among the sinks of that type.
+type NamedSink interface {
+	Sink
+	Name() string
+}
+
+// sinkNames returns the names of sinks, in the same order.
+func sinkNames(sinks []Sink) ([]string, error) {
+	names := make([]string, 0, len(sinks))
+	seen := make(map[string]bool, len(sinks))
+	unnamed := map[string]int{}
+
+	for _, s := range sinks {
+		var name string
+
+		if n, ok := s.(NamedSink); ok {
+			name = n.Name()
+		} else {
+			typ := fmt.Sprintf("%T", s)
+			name = fmt.Sprintf("%s#%d", typ, unnamed[typ])
+			unnamed[typ]++
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateSink, name)
+		}
+
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// globalTagsSetter is implemented by sinks that treat the exporter's global
+// tags apart from the labels of each series.
+type globalTagsSetter interface {
+	setGlobalTags(tags map[string]string)
+}
+
+// DemmonSink pushes series to demmon through a demmon client.
+type DemmonSink struct {
+	client    *client.DemmonClient
+	connected func() bool
+}
+
+// NewDemmonSink returns a sink that pushes to demmon through c.
+func NewDemmonSink(c *client.DemmonClient) *DemmonSink {
+	return &DemmonSink{client: c}
+}
+
+// Name implements NamedSink.
+func (s *DemmonSink) Name() string {
+	return "demmon"
+}
+
+// down reports whether the sink is known to be unable to take a batch, so
+// that deferred batches are held back rather than tried against it.
+func (s *DemmonSink) down() bool {
+	return s.connected != nil && !s.connected()
+}
+
+// Push implements Sink. The client takes no context, so a push still running
+// at the deadline of ctx is abandoned rather than waited for.
+func (s *DemmonSink) Push(ctx context.Context, batch []Series) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.down() {
+		return errNotConnected
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		return s.client.PushMetricBlob(series.DTOs(batch))
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.client.PushMetricBlob(series.DTOs(batch))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FanoutSink pushes every batch to several sinks. A failing or panicking sink
+// does not keep the batch from the others.
+type FanoutSink struct {
+	sinks []Sink
+}
+
+// NewFanoutSink returns a sink that pushes to all the given sinks.
+func NewFanoutSink(sinks ...Sink) *FanoutSink {
+	return &FanoutSink{sinks: sinks}
+}
+
+// FanoutError is returned by FanoutSink.Push when some of its sinks failed.
+type FanoutError struct {
+	// Failed holds the indexes, in the order the sinks were given to
+	// NewFanoutSink, of the sinks that failed, and Errs their errors.
+	Failed []int
+	Errs   []error
+}
+
+func (e *FanoutError) Error() string {
+	if len(e.Errs) == 1 {
+		return e.Errs[0].Error()
+	}
+
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Sprintf("%d sinks failed: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// Push implements Sink.
+func (f *FanoutSink) Push(ctx context.Context, batch []Series) error {
+	var fanoutErr *FanoutError
+
+	for i, s := range f.sinks {
+		if err := pushIsolated(ctx, s, batch); err != nil {
+			if fanoutErr == nil {
+				fanoutErr = &FanoutError{}
+			}
+
+			fanoutErr.Failed = append(fanoutErr.Failed, i)
+			fanoutErr.Errs = append(fanoutErr.Errs, err)
+		}
+	}
+
+	if fanoutErr == nil {
+		return nil
+	}
+
+	return fanoutErr
+}
+
+func pushIsolated(ctx context.Context, s Sink, batch []Series) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sink panicked: %v", r)
+		}
+	}()
+
+	return s.Push(ctx, batch)
+}
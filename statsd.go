@@ -0,0 +1,248 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+	"github.com/nm-morais/demmon-exporter/internal/statsd"
+)
+
+const (
+	defaultStatsDMTU           = 1432
+	defaultStatsDFlushInterval = 100 * time.Millisecond
+)
+
+// statsdEmitter sends observations to a StatsD agent, either as they happen
+// or, in aggregate mode, from the stores on every Export.
+type statsdEmitter struct {
+	conn      net.Conn
+	packer    *statsd.Packer
+	histType  string
+	constTags string
+	stream    bool
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newStatsDEmitter(confs *Conf, tags map[string]string) (*statsdEmitter, error) {
+	histType := confs.StatsDHistogramType
+	if histType == "" {
+		histType = statsd.Histogram
+	}
+
+	if histType != statsd.Histogram && histType != statsd.Timing {
+		return nil, fmt.Errorf("invalid StatsD histogram type %q", histType)
+	}
+
+	mtu := confs.StatsDMTU
+	if mtu <= 0 {
+		mtu = defaultStatsDMTU
+	}
+
+	conn, err := net.Dial("udp", confs.StatsDAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k, tags[k])
+	}
+
+	s := &statsdEmitter{
+		conn:      conn,
+		packer:    statsd.NewPacker(conn, mtu),
+		histType:  histType,
+		constTags: statsd.EncodeTags(pairs),
+		stream:    confs.StatsDStream,
+		stop:      make(chan struct{}),
+	}
+
+	if s.stream {
+		interval := confs.StatsDFlushInterval
+		if interval <= 0 {
+			interval = defaultStatsDFlushInterval
+		}
+
+		s.stopped.Add(1)
+
+		go s.flushLoop(interval)
+	}
+
+	return s, nil
+}
+
+// flushLoop sends the partly filled datagram of the streaming mode every
+// interval, so that lines are packed together without being held for long.
+func (s *statsdEmitter) flushLoop(interval time.Duration) {
+	defer s.stopped.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			_ = s.packer.Flush()
+		}
+	}
+}
+
+// statsdObserver wraps the store method f of a metric whose observations are
+// StatsD lines of type typ. In the streaming StatsD mode the observations are
+// sent as they happen; in the aggregating one, histogram observations are also
+// kept raw until the next Export.
+func (e *Exporter) statsdObserver(f storeFunc, typ string, signed bool) storeFunc {
+	switch {
+	case e.statsd == nil:
+		return f
+	case e.statsd.stream:
+		return e.statsd.streamed(f, typ, signed)
+	case typ == statsd.Histogram:
+		return func(name string, lvs lv.LabelValues, value float64) error {
+			err := f(name, lvs, value)
+			if err != nil && !errors.Is(err, lv.ErrSeriesFolded) {
+				return err
+			}
+
+			if err != nil {
+				lvs = lv.OverflowLabelValues
+			}
+
+			if obsErr := e.timings.Observe(name, lvs, value); obsErr != nil {
+				return obsErr
+			}
+
+			return err
+		}
+	}
+
+	return f
+}
+
+func (s *statsdEmitter) write(name string, lvs lv.LabelValues, value float64, typ string, signed bool) error {
+	lvs, err := lvs.Canonical()
+	if err != nil {
+		return err
+	}
+
+	line, err := statsd.AppendLine(nil, name, value, typ, signed, lvs, s.constTags)
+	if err != nil {
+		return err
+	}
+
+	return s.packer.Write(line)
+}
+
+// streamed returns a store method that also sends each observation it keeps
+// as a StatsD line of the given type, under the labels of the series that
+// kept it. Lines are packed into the current datagram, which goes out when
+// full or on the next tick of flushLoop.
+func (s *statsdEmitter) streamed(f storeFunc, typ string, signed bool) storeFunc {
+	if typ == statsd.Histogram {
+		typ = s.histType
+	}
+
+	return func(name string, lvs lv.LabelValues, value float64) error {
+		err := f(name, lvs, value)
+		if err != nil && !errors.Is(err, lv.ErrSeriesFolded) {
+			return err
+		}
+
+		if err != nil {
+			// the store kept the observation in the overflow series
+			lvs = lv.OverflowLabelValues
+		}
+
+		sign := signed
+
+		if typ == statsd.Gauge && !sign && value < 0 {
+			// a negative value would be read as a decrement
+			if err := s.write(name, lvs, 0, typ, false); err != nil {
+				return err
+			}
+
+			sign = true
+		}
+
+		if writeErr := s.write(name, lvs, value, typ, sign); writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+}
+
+// emit sends the contents of the stores reset by Export: counters summed,
+// gauges at their last value and every histogram and summary observation.
+func (s *statsdEmitter) emit(counters, gauges, timings *lv.Space) error {
+	var lastErr error
+
+	send := func(name string, lvs lv.LabelValues, value float64, typ string, signed bool) {
+		if err := s.write(name, lvs, value, typ, signed); err != nil {
+			lastErr = err
+		}
+	}
+
+	counters.Walk(func(name string, lvs lv.LabelValues, values []float64) bool {
+		send(name, lvs, sum(values), statsd.Counter, false)
+		return true
+	})
+
+	gauges.Walk(func(name string, lvs lv.LabelValues, values []float64) bool {
+		v := last(values)
+		if v < 0 {
+			send(name, lvs, 0, statsd.Gauge, false)
+			send(name, lvs, v, statsd.Gauge, true)
+
+			return true
+		}
+
+		send(name, lvs, v, statsd.Gauge, false)
+
+		return true
+	})
+
+	if timings != nil {
+		timings.Walk(func(name string, lvs lv.LabelValues, values []float64) bool {
+			for _, v := range values {
+				send(name, lvs, v, s.histType, false)
+			}
+
+			return true
+		})
+	}
+
+	if err := s.packer.Flush(); err != nil {
+		lastErr = err
+	}
+
+	return lastErr
+}
+
+func (s *statsdEmitter) close() error {
+	close(s.stop)
+	s.stopped.Wait()
+
+	err := s.packer.Flush()
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
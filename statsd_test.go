@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdListener returns a UDP socket standing in for the StatsD agent.
+func statsdListener(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// readLines reads the StatsD lines received until n are read or a second
+// passes.
+func readLines(t *testing.T, conn *net.UDPConn, n int) []string {
+	t.Helper()
+
+	var lines []string
+
+	buf := make([]byte, 65536)
+
+	for len(lines) < n {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read %q, want %d lines: %v", lines, n, err)
+		}
+
+		lines = append(lines, strings.Split(string(buf[:size]), "\n")...)
+	}
+
+	return lines
+}
+
+func TestStatsDStreamsFoldedObservations(t *testing.T) {
+	conn := statsdListener(t)
+
+	e := newTestExporter(t, &Conf{
+		StatsDAddr:          conn.LocalAddr().String(),
+		StatsDStream:        true,
+		StatsDFlushInterval: 10 * time.Millisecond,
+		MaxSeriesPerMetric:  1,
+	})
+
+	v := e.NewCounterVec("requests", 1, []string{"path"})
+
+	for _, path := range []string{"/a", "/b"} {
+		c, err := v.With("path", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Add(1)
+	}
+
+	lines := readLines(t, conn, 2)
+
+	if !strings.HasPrefix(lines[0], "requests:1|c|#path:/a,") {
+		t.Errorf("first line = %q, want it under its own labels", lines[0])
+	}
+
+	if !strings.HasPrefix(lines[1], "requests:1|c|#__overflow__:true,") {
+		t.Errorf("second line = %q, want it under the overflow labels", lines[1])
+	}
+
+	if n := e.Stats().Rejected["requests"]; n != 1 {
+		t.Errorf("%d series of requests were rejected, want 1", n)
+	}
+}
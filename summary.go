@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/generic"
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+	"github.com/nm-morais/demmon-exporter/internal/metrics"
+)
+
+// Summary tracks streaming quantiles of its observations. Every export emits
+// one field per quantile (e.g. "p99") plus count, sum, min and max.
+type Summary struct {
+	name string
+	lvs  lv.LabelValues
+	obs  observeFunc
+}
+
+// With implements metrics.Histogram.
+func (s *Summary) With(labelValues ...string) metrics.Histogram {
+	return &Summary{
+		name: s.name,
+		lvs:  s.lvs.With(labelValues...),
+		obs:  s.obs,
+	}
+}
+
+func (s *Summary) Observe(value float64) {
+	s.obs(s.name, s.lvs, value)
+}
+
+type summaryConf struct {
+	quantiles []float64
+	maxAge    time.Duration
+}
+
+type summarySeries struct {
+	lvs      lv.LabelValues
+	summary  *generic.Summary
+	started  time.Time
+	admitted bool // holds room in the limiter
+}
+
+// summaries holds one quantile sketch per summary name and label set, instead
+// of the raw observations an lv.Space would keep until the next export.
+type summaries struct {
+	mtx     sync.Mutex
+	confs   map[string]summaryConf
+	series  map[string]map[string]*summarySeries
+	limiter *lv.Limiter
+}
+
+func newSummaries() *summaries {
+	return &summaries{
+		confs:  map[string]summaryConf{},
+		series: map[string]map[string]*summarySeries{},
+	}
+}
+
+func (s *summaries) register(name string, conf summaryConf) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.confs[name] = conf
+}
+
+// unregister discards the series of the named summary and forgets it.
+func (s *summaries) unregister(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, series := range s.series[name] {
+		if series.admitted {
+			s.limiter.Release(name, 1)
+		}
+	}
+
+	delete(s.series, name)
+	delete(s.confs, name)
+}
+
+func (s *summaries) observe(name string, lvs lv.LabelValues, value float64) error {
+	lvs, err := lvs.Canonical()
+	if err != nil {
+		return err
+	}
+
+	series, err := s.seriesFor(name, lvs)
+	if series != nil {
+		series.summary.Observe(value)
+	}
+
+	return err
+}
+
+// seriesFor returns the series identified by lvs, creating it if the limiter
+// admits it. Series that are not admitted are folded into the overflow series
+// or dropped, like in an lv.Space.
+func (s *summaries) seriesFor(name string, lvs lv.LabelValues) (*summarySeries, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	byLabels, ok := s.series[name]
+	if !ok {
+		byLabels = map[string]*summarySeries{}
+		s.series[name] = byLabels
+	}
+
+	key := strings.Join(lvs, "\xff")
+
+	series, ok := byLabels[key]
+	if ok {
+		return series, nil
+	}
+
+	var err error
+
+	if s.limiter != nil && !s.limiter.Admit(name) {
+		if !s.limiter.Fold() {
+			return nil, lv.ErrSeriesDropped
+		}
+
+		lvs, err = lv.OverflowLabelValues, lv.ErrSeriesFolded
+		key = strings.Join(lvs, "\xff")
+
+		if series, ok = byLabels[key]; ok {
+			return series, err
+		}
+	}
+
+	series = &summarySeries{
+		lvs:      append(lv.LabelValues{}, lvs...),
+		summary:  generic.NewSummary(s.confs[name].quantiles),
+		started:  time.Now(),
+		admitted: s.limiter != nil && err == nil,
+	}
+	byLabels[key] = series
+
+	return series, err
+}
+
+// walk invokes fn with the current value of every summary that has
+// observations, and the start of the window it covers. A window is tumbling:
+// the summary starts over once it is at least maxAge old, or after every walk
+// when maxAge is zero; idle ones are discarded.
+func (s *summaries) walk(now time.Time, fn func(name string, lvs lv.LabelValues, started time.Time, fields map[string]interface{})) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for name, byLabels := range s.series {
+		maxAge := s.confs[name].maxAge
+
+		for key, series := range byLabels {
+			if series.summary.Count() == 0 {
+				delete(byLabels, key)
+
+				if series.admitted {
+					s.limiter.Release(name, 1)
+				}
+
+				continue
+			}
+
+			fn(name, series.lvs, series.started, series.summary.Value())
+
+			if maxAge == 0 || now.Sub(series.started) >= maxAge {
+				series.summary.Reset()
+				series.started = now
+			}
+		}
+
+		if len(byLabels) == 0 {
+			delete(s.series, name)
+		}
+	}
+}
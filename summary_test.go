@@ -0,0 +1,81 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nm-morais/demmon-exporter/internal/generic"
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+)
+
+func TestSummaryWindow(t *testing.T) {
+	s := newSummaries()
+	s.register("latency", summaryConf{quantiles: []float64{0.5}, maxAge: 10 * time.Second})
+
+	for _, v := range []float64{1, 2, 3} {
+		if err := s.observe("latency", nil, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opened := time.Now()
+
+	type window struct {
+		count   float64
+		started time.Time
+	}
+
+	walk := func(now time.Time) []window {
+		var got []window
+
+		s.walk(now, func(_ string, _ lv.LabelValues, started time.Time, fields map[string]interface{}) {
+			got = append(got, window{count: fields[generic.CountField].(float64), started: started})
+		})
+
+		return got
+	}
+
+	for _, tc := range []struct {
+		name    string
+		at      time.Duration
+		observe []float64
+		count   float64 // zero when nothing is emitted
+		started time.Duration
+	}{
+		{name: "within the window", at: 5 * time.Second, count: 3},
+		{name: "at the boundary", at: 11 * time.Second, count: 3},
+		{name: "next window", at: 12 * time.Second, observe: []float64{10}, count: 1, started: 11 * time.Second},
+		{name: "next boundary", at: 30 * time.Second, count: 1, started: 11 * time.Second},
+		{name: "idle", at: 31 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, v := range tc.observe {
+				if err := s.observe("latency", nil, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := walk(opened.Add(tc.at))
+
+			if tc.count == 0 {
+				if len(got) != 0 {
+					t.Errorf("walk() emitted %+v for an idle summary", got)
+				}
+
+				return
+			}
+
+			if len(got) != 1 || got[0].count != tc.count {
+				t.Fatalf("walk() = %+v, want a count of %v", got, tc.count)
+			}
+
+			switch started := got[0].started; {
+			case tc.started == 0 && started.After(opened):
+				// the first window opened with the first observation
+				t.Errorf("window started at %v, want before the first walk", started.Sub(opened))
+			case tc.started > 0 && !started.Equal(opened.Add(tc.started)):
+				t.Errorf("window started at %v, want at %v", started.Sub(opened), tc.started)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package exporter
+
+import (
+	"github.com/nm-morais/demmon-common/exporters"
+	"github.com/nm-morais/demmon-exporter/internal/lv"
+	"github.com/nm-morais/demmon-exporter/internal/metrics"
+)
+
+// LabelError is returned by the With and WithLabelValues methods of the metric
+// vectors for label values that do not match the declared label keys. It
+// wraps one of ErrUnknownLabel, ErrMissingLabel, ErrLabelCount,
+// ErrInvalidLabel or a label canonicalisation error.
+type LabelError = lv.LabelError
+
+var (
+	ErrUnknownLabel = lv.ErrUnknownLabel
+	ErrMissingLabel = lv.ErrMissingLabel
+	ErrLabelCount   = lv.ErrLabelCount
+	ErrInvalidLabel = lv.ErrInvalidLabel
+)
+
+// rejectFunc counts an observation that was dropped.
+type rejectFunc func(name string, lvs lv.LabelValues, err error)
+
+// CounterVec is a counter with a declared set of label keys.
+type CounterVec struct {
+	counter *Counter
+	schema  *lv.Schema
+	reject  rejectFunc
+}
+
+// NewCounterVec returns a counter whose series must set exactly the given
+// label keys. It panics on invalid label keys, or if name is registered with
+// other label keys or parameters; see RegisterCounterVec.
+func (e *Exporter) NewCounterVec(name string, nrSamplesToStore int, labels []string) *CounterVec {
+	v, err := e.RegisterCounterVec(name, nrSamplesToStore, labels)
+	if err != nil {
+		e.logger.Panic(err)
+	}
+
+	return v
+}
+
+// RegisterCounterVec is like NewCounterVec, but returns an error instead of
+// panicking. Vectors registered twice share their series.
+func (e *Exporter) RegisterCounterVec(name string, nrSamplesToStore int, labels []string) (*CounterVec, error) {
+	schema, err := lv.NewSchema(name, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	counter, err := e.registerCounter(name, nrSamplesToStore, schema.Keys())
+	if err != nil {
+		return nil, err
+	}
+
+	return &CounterVec{counter: counter, schema: schema, reject: e.reject}, nil
+}
+
+// With returns the counter for the given label/value pairs.
+func (v *CounterVec) With(labelValues ...string) (exporters.Counter, error) {
+	lvs, err := v.schema.Validate(labelValues)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vecCounter{vec: v, counter: v.counter.with(lvs)}, nil
+}
+
+// WithLabelValues returns the counter for the given label values, in the
+// order the label keys were declared.
+func (v *CounterVec) WithLabelValues(values ...string) (exporters.Counter, error) {
+	lvs, err := v.schema.LabelValues(values...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vecCounter{vec: v, counter: v.counter.with(lvs)}, nil
+}
+
+// vecCounter is a counter of a CounterVec. Its With keeps checking label
+// values against the vector's schema: the observations of a counter whose
+// label values do not match it are dropped and counted as rejected.
+type vecCounter struct {
+	vec     *CounterVec
+	counter *Counter
+	err     error
+}
+
+// With implements exporters.Counter.
+func (c *vecCounter) With(labelValues ...string) exporters.Counter {
+	if c.err != nil {
+		return c
+	}
+
+	lvs := c.counter.lvs.With(labelValues...)
+
+	canonical, err := c.vec.schema.Validate(lvs)
+	if err != nil {
+		return &vecCounter{vec: c.vec, counter: c.counter.with(lvs), err: err}
+	}
+
+	return &vecCounter{vec: c.vec, counter: c.counter.with(canonical)}
+}
+
+// Add implements exporters.Counter.
+func (c *vecCounter) Add(delta float64) {
+	if c.err != nil {
+		c.vec.reject(c.counter.name, c.counter.lvs, c.err)
+		return
+	}
+
+	c.counter.Add(delta)
+}
+
+// GaugeVec is a gauge with a declared set of label keys.
+type GaugeVec struct {
+	gauge  *Gauge
+	schema *lv.Schema
+	reject rejectFunc
+}
+
+// NewGaugeVec returns a gauge whose series must set exactly the given label
+// keys. It panics on invalid label keys, or if name is registered with other
+// label keys or parameters; see RegisterGaugeVec.
+func (e *Exporter) NewGaugeVec(name string, nrSamplesToStore int, labels []string) *GaugeVec {
+	v, err := e.RegisterGaugeVec(name, nrSamplesToStore, labels)
+	if err != nil {
+		e.logger.Panic(err)
+	}
+
+	return v
+}
+
+// RegisterGaugeVec is like NewGaugeVec, but returns an error instead of
+// panicking. Vectors registered twice share their series.
+func (e *Exporter) RegisterGaugeVec(name string, nrSamplesToStore int, labels []string) (*GaugeVec, error) {
+	schema, err := lv.NewSchema(name, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	gauge, err := e.registerGauge(name, nrSamplesToStore, schema.Keys())
+	if err != nil {
+		return nil, err
+	}
+
+	return &GaugeVec{gauge: gauge, schema: schema, reject: e.reject}, nil
+}
+
+// With returns the gauge for the given label/value pairs.
+func (v *GaugeVec) With(labelValues ...string) (exporters.Gauge, error) {
+	lvs, err := v.schema.Validate(labelValues)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vecGauge{vec: v, gauge: v.gauge.with(lvs)}, nil
+}
+
+// WithLabelValues returns the gauge for the given label values, in the order
+// the label keys were declared.
+func (v *GaugeVec) WithLabelValues(values ...string) (exporters.Gauge, error) {
+	lvs, err := v.schema.LabelValues(values...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vecGauge{vec: v, gauge: v.gauge.with(lvs)}, nil
+}
+
+// vecGauge is a gauge of a GaugeVec. Its With keeps checking label values
+// against the vector's schema: the observations of a gauge whose label values
+// do not match it are dropped and counted as rejected.
+type vecGauge struct {
+	vec   *GaugeVec
+	gauge *Gauge
+	err   error
+}
+
+// With implements exporters.Gauge.
+func (c *vecGauge) With(labelValues ...string) exporters.Gauge {
+	if c.err != nil {
+		return c
+	}
+
+	lvs := c.gauge.lvs.With(labelValues...)
+
+	canonical, err := c.vec.schema.Validate(lvs)
+	if err != nil {
+		return &vecGauge{vec: c.vec, gauge: c.gauge.with(lvs), err: err}
+	}
+
+	return &vecGauge{vec: c.vec, gauge: c.gauge.with(canonical)}
+}
+
+// Set implements exporters.Gauge.
+func (c *vecGauge) Set(value float64) {
+	if c.err != nil {
+		c.vec.reject(c.gauge.name, c.gauge.lvs, c.err)
+		return
+	}
+
+	c.gauge.Set(value)
+}
+
+// Add implements exporters.Gauge.
+func (c *vecGauge) Add(delta float64) {
+	if c.err != nil {
+		c.vec.reject(c.gauge.name, c.gauge.lvs, c.err)
+		return
+	}
+
+	c.gauge.Add(delta)
+}
+
+// HistogramVec is a histogram with a declared set of label keys.
+type HistogramVec struct {
+	histogram *Histogram
+	schema    *lv.Schema
+	reject    rejectFunc
+}
+
+// NewHistogramVec returns a histogram whose series must set exactly the given
+// label keys. It panics on invalid label keys or bounds, or if name is
+// registered with other label keys or parameters; see RegisterHistogramVec.
+func (e *Exporter) NewHistogramVec(name string, nrSamplesToStore int, upperBucketBounds []float64, labels []string) *HistogramVec {
+	v, err := e.RegisterHistogramVec(name, nrSamplesToStore, upperBucketBounds, labels)
+	if err != nil {
+		e.logger.Panic(err)
+	}
+
+	return v
+}
+
+// RegisterHistogramVec is like NewHistogramVec, but returns an error instead of
+// panicking. Vectors registered twice share their series.
+func (e *Exporter) RegisterHistogramVec(name string, nrSamplesToStore int, upperBounds []float64, labels []string) (*HistogramVec, error) {
+	schema, err := lv.NewSchema(name, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	histogram, err := e.registerHistogram(name, nrSamplesToStore, upperBounds, schema.Keys())
+	if err != nil {
+		return nil, err
+	}
+
+	return &HistogramVec{histogram: histogram, schema: schema, reject: e.reject}, nil
+}
+
+// With returns the histogram for the given label/value pairs.
+func (v *HistogramVec) With(labelValues ...string) (metrics.Histogram, error) {
+	lvs, err := v.schema.Validate(labelValues)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vecHistogram{vec: v, histogram: v.histogram.with(lvs)}, nil
+}
+
+// WithLabelValues returns the histogram for the given label values, in the
+// order the label keys were declared.
+func (v *HistogramVec) WithLabelValues(values ...string) (metrics.Histogram, error) {
+	lvs, err := v.schema.LabelValues(values...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vecHistogram{vec: v, histogram: v.histogram.with(lvs)}, nil
+}
+
+// vecHistogram is a histogram of a HistogramVec. Its With keeps checking
+// label values against the vector's schema: the observations of a histogram
+// whose label values do not match it are dropped and counted as rejected.
+type vecHistogram struct {
+	vec       *HistogramVec
+	histogram *Histogram
+	err       error
+}
+
+// With implements metrics.Histogram.
+func (c *vecHistogram) With(labelValues ...string) metrics.Histogram {
+	if c.err != nil {
+		return c
+	}
+
+	lvs := c.histogram.lvs.With(labelValues...)
+
+	canonical, err := c.vec.schema.Validate(lvs)
+	if err != nil {
+		return &vecHistogram{vec: c.vec, histogram: c.histogram.with(lvs), err: err}
+	}
+
+	return &vecHistogram{vec: c.vec, histogram: c.histogram.with(canonical)}
+}
+
+// Observe implements metrics.Histogram.
+func (c *vecHistogram) Observe(value float64) {
+	if c.err != nil {
+		c.vec.reject(c.histogram.name, c.histogram.lvs, c.err)
+		return
+	}
+
+	c.histogram.Observe(value)
+}